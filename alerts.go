@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Alert states
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule describes a latency condition to alert on. Every condition which
+// is set must hold for the rule to match a node.
+type AlertRule struct {
+	Name string `yaml:"name"`
+	// Pods limits the rule to the named pods, all pods if empty
+	Pods []string `yaml:"pods"`
+	// Event limits the rule to a latency event class such as "fork"
+	Event string `yaml:"event"`
+	// MaxSpikeMs matches if a spike in the window exceeded this many ms
+	MaxSpikeMs int64 `yaml:"max_spike_ms"`
+	// SpikeCount matches if there were more than this many spikes in the window
+	SpikeCount int `yaml:"spike_count"`
+	// Window is how far back to look at the history, such as "5m"
+	Window string `yaml:"window"`
+	// FireAfter is the number of consecutive matches before the alert fires
+	FireAfter int `yaml:"fire_after"`
+	// ResolveAfter is the number of consecutive misses before it resolves
+	ResolveAfter int    `yaml:"resolve_after"`
+	Severity     string `yaml:"severity"`
+
+	window time.Duration
+}
+
+// Alert is the state of a rule against a single node
+type Alert struct {
+	Rule     string
+	Severity string
+	Node     string
+	Pod      string
+	State    string
+	Message  string
+	StartsAt time.Time
+	EndsAt   time.Time
+
+	matches int
+	misses  int
+}
+
+// AlertConfig is the alerting configuration loaded from
+// config.AlertConfigFile or given inline in the config file.
+type AlertConfig struct {
+	Rules    []AlertRule `yaml:"rules"`
+	Webhooks []string    `yaml:"webhooks"`
+	Exec     []string    `yaml:"exec"`
+	SMTP     *SMTPSink   `yaml:"smtp"`
+}
+
+var alertRules []AlertRule
+var alertSinks []AlertSink
+
+// alerts holds the pending and firing alerts keyed by rule and node
+var alerts = make(map[string]*Alert)
+var alertsLock sync.Mutex
+
+// alertQueueSize is how many alerts can wait for delivery before new ones
+// are dropped
+const alertQueueSize = 256
+
+// alertQueue feeds the alert sender, which delivers alerts one at a time in
+// the order they fired or resolved
+var alertQueue = make(chan Alert, alertQueueSize)
+var startSender sync.Once
+
+// LoadAlertConfig reads the alerting config from the file. It uses the same
+// YAML schema as the alerts section of the config file, JSON being valid
+// YAML, and unknown keys are an error.
+func LoadAlertConfig(filename string) (ac AlertConfig, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ac, err
+	}
+	err = yaml.UnmarshalStrict(data, &ac)
+	if err != nil {
+		return ac, fmt.Errorf("Unable to parse %s: %s", filename, err.Error())
+	}
+	return ac, ac.prepare()
+}
+
+// prepare checks every rule and fills in their defaults
+func (ac *AlertConfig) prepare() error {
+	for i := range ac.Rules {
+		err := ac.Rules[i].prepare()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureAlerting sets up the rules and sinks from the alert config
+func configureAlerting(ac AlertConfig) {
+	alertRules = ac.Rules
+	alertSinks = nil
+	for _, url := range ac.Webhooks {
+		alertSinks = append(alertSinks, &WebhookSink{URL: url})
+	}
+	for _, command := range ac.Exec {
+		alertSinks = append(alertSinks, &ExecSink{Command: command})
+	}
+	if ac.SMTP != nil {
+		alertSinks = append(alertSinks, ac.SMTP)
+	}
+	startSender.Do(func() { go sendAlerts() })
+}
+
+func (r *AlertRule) prepare() error {
+	if r.Name == "" {
+		return fmt.Errorf("Alert rule without a name")
+	}
+	if r.MaxSpikeMs == 0 && r.SpikeCount == 0 && r.Event == "" {
+		return fmt.Errorf("Alert rule %s has no conditions", r.Name)
+	}
+	r.window = 5 * time.Minute
+	if r.Window != "" {
+		window, err := time.ParseDuration(r.Window)
+		if err != nil {
+			return fmt.Errorf("Alert rule %s has an invalid window: %s", r.Name, err.Error())
+		}
+		r.window = window
+	}
+	if r.FireAfter < 1 {
+		r.FireAfter = 1
+	}
+	if r.ResolveAfter < 1 {
+		r.ResolveAfter = 1
+	}
+	return nil
+}
+
+func (r AlertRule) appliesTo(podname string) bool {
+	if len(r.Pods) == 0 {
+		return true
+	}
+	for _, name := range r.Pods {
+		if name == podname {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate checks the rule against the node's history and returns whether it
+// matched along with a description of what was found. The caller must hold
+// nodesLock.
+func (r AlertRule) evaluate(node *Node, now time.Time) (bool, string) {
+	since := now.Add(-r.window).Unix()
+	var spikes int
+	var max int64
+	var events []string
+	for event, samples := range node.History {
+		if r.Event != "" && event != r.Event {
+			continue
+		}
+		found := false
+		for _, sample := range samples {
+			if sample.Timestamp < since {
+				continue
+			}
+			found = true
+			spikes++
+			if sample.Latency > max {
+				max = sample.Latency
+			}
+		}
+		if found {
+			events = append(events, event)
+		}
+	}
+	if spikes == 0 {
+		return false, ""
+	}
+	if r.MaxSpikeMs > 0 && max <= r.MaxSpikeMs {
+		return false, ""
+	}
+	if r.SpikeCount > 0 && spikes <= r.SpikeCount {
+		return false, ""
+	}
+	sort.Strings(events)
+	return true, fmt.Sprintf("%d spikes in the last %s, max %dms (%s)", spikes, r.window, max, strings.Join(events, ","))
+}
+
+// evaluateAlerts runs every rule against the nodes which were just polled
+// successfully, updating the alert states and notifying the sinks of alerts
+// which fire or resolve. The alerts of a node left out are unchanged.
+func evaluateAlerts(nodes []*Node) {
+	if len(alertRules) == 0 {
+		return
+	}
+	now := time.Now()
+	var notify []Alert
+	nodesLock.RLock()
+	alertsLock.Lock()
+	for _, node := range nodes {
+		for _, rule := range alertRules {
+			if !rule.appliesTo(node.Pod.Name) {
+				continue
+			}
+			matched, msg := rule.evaluate(node, now)
+			key := rule.Name + "/" + node.Name
+			alert, exists := alerts[key]
+			if matched {
+				if !exists {
+					alert = &Alert{Rule: rule.Name, Severity: rule.Severity, Node: node.Name, Pod: node.Pod.Name, State: AlertPending, StartsAt: now}
+					alerts[key] = alert
+				}
+				alert.Message = msg
+				alert.matches++
+				alert.misses = 0
+				if alert.State == AlertPending && alert.matches >= rule.FireAfter {
+					alert.State = AlertFiring
+					notify = append(notify, *alert)
+				}
+				continue
+			}
+			if !exists {
+				continue
+			}
+			alert.misses++
+			alert.matches = 0
+			if alert.State == AlertPending {
+				delete(alerts, key)
+			} else if alert.misses >= rule.ResolveAfter {
+				alert.State = AlertResolved
+				alert.EndsAt = now
+				notify = append(notify, *alert)
+				delete(alerts, key)
+			}
+		}
+	}
+	// resolve alerts of nodes which are no longer monitored
+	for key, alert := range alerts {
+		if node, exists := Nodes[alert.Node]; exists && node.State != NodeRemoved {
+			continue
+		}
+		if alert.State == AlertFiring {
+			alert.State = AlertResolved
+			alert.EndsAt = now
+			alert.Message = "node is no longer monitored"
+			notify = append(notify, *alert)
+		}
+		delete(alerts, key)
+	}
+	alertsLock.Unlock()
+	nodesLock.RUnlock()
+	for _, alert := range notify {
+		queueAlert(alert)
+	}
+}
+
+// queueAlert hands the alert to the sender. If the sinks are so slow the
+// queue is full the alert is dropped rather than holding up the poll.
+func queueAlert(alert Alert) {
+	select {
+	case alertQueue <- alert:
+	default:
+		logger.Warning(fmt.Sprintf("Alert queue full, dropping alert %s %s on %s", alert.Rule, alert.State, alert.Node))
+	}
+}
+
+// sendAlerts delivers the queued alerts to every sink
+func sendAlerts() {
+	for alert := range alertQueue {
+		logger.Warning(fmt.Sprintf("Alert %s %s on %s: %s", alert.Rule, alert.State, alert.Node, alert.Message))
+		for _, sink := range alertSinks {
+			err := sink.Notify(alert)
+			if err != nil {
+				logger.Warning(fmt.Sprintf("Unable to deliver alert %s to %s: %s", alert.Rule, sink, err.Error()))
+			}
+		}
+	}
+}
+
+// activeAlerts returns the pending and firing alerts
+func activeAlerts() []Alert {
+	alertsLock.Lock()
+	defer alertsLock.Unlock()
+	active := make([]Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		active = append(active, *alert)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Rule != active[j].Rule {
+			return active[i].Rule < active[j].Rule
+		}
+		return active[i].Node < active[j].Node
+	})
+	return active
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// AlertSink is somewhere alerts are delivered to
+type AlertSink interface {
+	Notify(a Alert) error
+	String() string
+}
+
+// WebhookSink POSTs each alert as JSON to a URL
+type WebhookSink struct {
+	URL string
+}
+
+func (s *WebhookSink) Notify(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	hc := http.Client{Timeout: 10 * time.Second}
+	resp, err := hc.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) String() string {
+	return "webhook " + s.URL
+}
+
+// ExecSink runs a command for each alert. The alert is passed as JSON on
+// stdin and its main fields as CANDUI_ALERT_* environment variables.
+type ExecSink struct {
+	Command string
+}
+
+func (s *ExecSink) Notify(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("/bin/sh", "-c", s.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"CANDUI_ALERT_RULE="+a.Rule,
+		"CANDUI_ALERT_STATE="+a.State,
+		"CANDUI_ALERT_SEVERITY="+a.Severity,
+		"CANDUI_ALERT_NODE="+a.Node,
+		"CANDUI_ALERT_POD="+a.Pod,
+		"CANDUI_ALERT_MESSAGE="+a.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (s *ExecSink) String() string {
+	return "exec " + s.Command
+}
+
+// SMTPSink mails each alert
+type SMTPSink struct {
+	Server   string   `yaml:"server"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+func (s *SMTPSink) Notify(a Alert) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := strings.Split(s.Server, ":")[0]
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	subject := fmt.Sprintf("[candui] %s %s on %s", strings.ToUpper(a.State), a.Rule, a.Node)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n", s.From, strings.Join(s.To, ", "), subject)
+	fmt.Fprintf(&msg, "Rule: %s\r\nSeverity: %s\r\nPod: %s\r\nNode: %s\r\nState: %s\r\nSince: %s\r\n\r\n%s\r\n",
+		a.Rule, a.Severity, a.Pod, a.Node, a.State, a.StartsAt.Format(time.RFC3339), a.Message)
+	return smtp.SendMail(s.Server, auth, s.From, s.To, msg.Bytes())
+}
+
+func (s *SMTPSink) String() string {
+	return "smtp " + s.Server
+}
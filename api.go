@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NodeStatus is the API view of a node
+type NodeStatus struct {
+	Name           string
+	Pod            string
+	Role           string
+	State          string
+	Healthy        bool
+	LastError      string
+	LastPoll       time.Time
+	SentinelStatus string
+	Threshold      int
+	Unmonitored    bool
+}
+
+// NodeDetail is the API view of a node including its latency data
+type NodeDetail struct {
+	NodeStatus
+	Events      map[string]LatencyEvent
+	History     map[string][]LatencySample
+	Annotations []Annotation
+	LastReport  *DiagnosticReport
+	Slowlog     []SlowlogEntry
+	Info        *RedisInfo
+	Rates       *InfoRates
+	Persistence []PersistenceEvent
+}
+
+// PodRollup aggregates the latency state of every node in a pod
+type PodRollup struct {
+	Name             string
+	Master           string
+	Nodes            []NodeStatus
+	LatentNodes      int
+	UnmonitoredNodes int
+	Events           map[string]LatencyEvent
+	Spikes           map[string]int
+}
+
+func (n *Node) status() NodeStatus {
+	return NodeStatus{
+		Name:           n.Name,
+		Pod:            n.Pod.Name,
+		Role:           n.Role,
+		State:          n.State,
+		Healthy:        n.State == NodeHealthy,
+		LastError:      n.LastError,
+		LastPoll:       n.LastPoll,
+		SentinelStatus: n.SentinelStatus,
+		Threshold:      n.Threshold,
+		Unmonitored:    n.unmonitored(),
+	}
+}
+
+// detail returns a snapshot of the node which can be encoded once nodesLock
+// is released. The caller must hold nodesLock. The slices are only ever
+// appended to or replaced, so sharing them is safe; the maps are copied.
+func (n *Node) detail() NodeDetail {
+	events := make(map[string]LatencyEvent, len(n.Events))
+	for name, event := range n.Events {
+		events[name] = event
+	}
+	history := make(map[string][]LatencySample, len(n.History))
+	for name, samples := range n.History {
+		history[name] = samples
+	}
+	return NodeDetail{NodeStatus: n.status(), Events: events, History: history, Annotations: n.Annotations, LastReport: n.LastReport, Slowlog: n.Slowlog, Info: n.Info, Rates: n.Rates, Persistence: n.Persistence}
+}
+
+// buildPodRollups groups the nodes by pod. The caller must hold nodesLock.
+func buildPodRollups() map[string]*PodRollup {
+	pods := make(map[string]*PodRollup)
+	for _, node := range Nodes {
+		pod, exists := pods[node.Pod.Name]
+		if !exists {
+			pod = &PodRollup{
+				Name:   node.Pod.Name,
+				Master: node.Pod.Address(),
+				Events: make(map[string]LatencyEvent),
+				Spikes: make(map[string]int),
+			}
+			pods[node.Pod.Name] = pod
+		}
+		status := node.status()
+		pod.Nodes = append(pod.Nodes, status)
+		if status.Unmonitored {
+			pod.UnmonitoredNodes++
+		}
+		if len(node.Events) > 0 {
+			pod.LatentNodes++
+		}
+		for name, event := range node.Events {
+			agg := pod.Events[name]
+			agg.Name = name
+			if event.Timestamp > agg.Timestamp {
+				agg.Timestamp = event.Timestamp
+				agg.Latest = event.Latest
+			}
+			if event.Max > agg.Max {
+				agg.Max = event.Max
+			}
+			pod.Events[name] = agg
+			pod.Spikes[name] += len(node.History[name])
+		}
+	}
+	for _, pod := range pods {
+		sort.Slice(pod.Nodes, func(i, j int) bool { return pod.Nodes[i].Name < pod.Nodes[j].Name })
+	}
+	return pods
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Warning("Unable to encode API response: " + err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// handleNodes snapshots the nodes under nodesLock and encodes them after
+// releasing it, so a slow client can't hold up polling.
+func handleNodes(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/nodes")
+	name = strings.Trim(name, "/")
+	if name == "" {
+		nodes := []NodeStatus{}
+		nodesLock.RLock()
+		for _, node := range Nodes {
+			nodes = append(nodes, node.status())
+		}
+		nodesLock.RUnlock()
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+		writeJSON(w, http.StatusOK, nodes)
+		return
+	}
+	nodesLock.RLock()
+	node, exists := Nodes[name]
+	var detail NodeDetail
+	if exists {
+		detail = node.detail()
+	}
+	nodesLock.RUnlock()
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "no such node: "+name)
+		return
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func handlePods(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/pods")
+	name = strings.Trim(name, "/")
+	if strings.HasSuffix(name, "/replication") {
+		handlePodReplication(w, strings.TrimSuffix(name, "/replication"))
+		return
+	}
+	nodesLock.RLock()
+	pods := buildPodRollups()
+	nodesLock.RUnlock()
+	if name == "" {
+		rollups := []*PodRollup{}
+		for _, pod := range pods {
+			rollups = append(rollups, pod)
+		}
+		sort.Slice(rollups, func(i, j int) bool { return rollups[i].Name < rollups[j].Name })
+		writeJSON(w, http.StatusOK, rollups)
+		return
+	}
+	pod, exists := pods[name]
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "no such pod: "+name)
+		return
+	}
+	writeJSON(w, http.StatusOK, pod)
+}
+
+func handlePodReplication(w http.ResponseWriter, name string) {
+	nodesLock.RLock()
+	pods := buildPodReplication()
+	nodesLock.RUnlock()
+	pod, exists := pods[name]
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "no such pod: "+name)
+		return
+	}
+	writeJSON(w, http.StatusOK, pod)
+}
+
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, activeAlerts())
+}
+
+// startHTTPServer serves the JSON API on the configured listen address
+func startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/nodes", handleNodes)
+	mux.HandleFunc("/api/nodes/", handleNodes)
+	mux.HandleFunc("/api/pods", handlePods)
+	mux.HandleFunc("/api/pods/", handlePods)
+	mux.HandleFunc("/api/alerts", handleAlerts)
+	mux.HandleFunc("/api/replication", handleReplication)
+	mux.HandleFunc("/api/topology", handleTopology)
+	mux.HandleFunc("/metrics", handleMetrics)
+	logger.Info("HTTP API listening on " + config.HTTPListen)
+	err := http.ListenAndServe(config.HTTPListen, mux)
+	if err != nil {
+		logger.Crit("HTTP API stopped: " + err.Error())
+	}
+}
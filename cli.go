@@ -0,0 +1,309 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/therealbill/libredis/client"
+)
+
+const usage = `usage: candui [command] [flags] [args]
+
+commands:
+  run                     poll the nodes continuously, the default
+  check                   poll every node once and print a table, exiting
+                          1 if any node had spikes in the last -window and
+                          2 if any node failed
+  nagios                  poll every node once and report as a Nagios or
+                          Icinga plugin, see candui nagios -h
+  nodes                   list the nodes of the configured topology
+  history <node> <event>  print the latency history of an event on a node
+  doctor <node>           print the LATENCY DOCTOR report of a node
+  config check|dump       validate or print the configuration
+
+Every command takes the configuration flags, see candui run -h.
+`
+
+// Exit codes of the check command
+const (
+	checkOK     = 0
+	checkSpikes = 1
+	checkFailed = 2
+)
+
+// runCLI runs the command named by the first argument and returns the exit
+// code. Without a command, or if the first argument is a flag, candui runs
+// as a daemon as it always has.
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		return runCommand(args)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "run":
+		return runCommand(args)
+	case "check":
+		return checkCommand(args)
+	case "nagios":
+		return nagiosCommand(args)
+	case "nodes":
+		return nodesCommand(args)
+	case "history":
+		return historyCommand(args)
+	case "doctor":
+		return doctorCommand(args)
+	case "config":
+		return configCommand(args)
+	case "help", "-h", "-help":
+		fmt.Print(usage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+	return 2
+}
+
+// commandSetup loads the configuration for a command from its flags and
+// checks it was given the expected number of arguments, returning them.
+func commandSetup(command string, args []string, argNames ...string) ([]string, bool) {
+	return commandSetupWithFlags(command, args, nil, argNames...)
+}
+
+// commandSetupWithFlags is commandSetup for a command with flags of its own,
+// added to the flag set by extra.
+func commandSetupWithFlags(command string, args []string, extra func(*flag.FlagSet), argNames ...string) ([]string, bool) {
+	var adders []func(*flag.FlagSet)
+	if extra != nil {
+		adders = append(adders, extra)
+	}
+	cfg, rest, err := loadLaunchConfig("candui "+command, args, adders...)
+	if err == flag.ErrHelp {
+		return nil, false
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return nil, false
+	}
+	if len(rest) != len(argNames) {
+		fmt.Fprintf(os.Stderr, "usage: candui %s [flags] %s\n", command, strings.Join(argNames, " "))
+		return nil, false
+	}
+	setup(cfg)
+	return rest, true
+}
+
+func runCommand(args []string) int {
+	if _, ok := commandSetup("run", args); !ok {
+		return 2
+	}
+	runDaemon()
+	return 0
+}
+
+// checkCommand polls every node once and prints the events which had spikes
+// within the window. LATENCY LATEST keeps an event until it is reset, so only
+// recent spikes count or a node would fail the check for good once it spiked.
+func checkCommand(args []string) int {
+	window := 5 * time.Minute
+	addFlags := func(fs *flag.FlagSet) {
+		fs.DurationVar(&window, "window", window, "only count spikes within this long")
+	}
+	if _, ok := commandSetupWithFlags("check", args, addFlags); !ok {
+		return checkFailed
+	}
+	results := pollOnce()
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "No nodes found in the topology")
+		return checkFailed
+	}
+	now := time.Now()
+	writeCheckTable(os.Stdout, results, window, now)
+	return checkStatus(results, window, now)
+}
+
+// checkStatus returns the exit code for the poll results: checkSpikes if any
+// node had spikes within the window, otherwise checkFailed if any node
+// couldn't be polled.
+func checkStatus(results []pollResult, window time.Duration, now time.Time) int {
+	cutoff := now.Add(-window).Unix()
+	status := checkOK
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	for _, res := range results {
+		if res.Err != nil {
+			status = checkFailed
+			continue
+		}
+		for name := range res.Node.Events {
+			if spikes, _ := res.Node.spikesSince(name, cutoff); spikes > 0 {
+				return checkSpikes
+			}
+		}
+	}
+	return status
+}
+
+// writeCheckTable writes a row per node, and per event with spikes within the
+// window, of the poll results
+func writeCheckTable(out io.Writer, results []pollResult, window time.Duration, now time.Time) {
+	cutoff := now.Add(-window).Unix()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPOD\tROLE\tSTATUS\tEVENT\tLATEST(ms)\tMAX(ms)\tSPIKES")
+	nodesLock.RLock()
+	for _, res := range results {
+		n := res.Node
+		row := fmt.Sprintf("%s\t%s\t%s", n.Name, n.Pod.Name, res.Role)
+		switch {
+		case res.Err != nil:
+			fmt.Fprintf(w, "%s\terror: %s\t-\t-\t-\t-\n", row, res.Err.Error())
+			continue
+		case res.Unmonitored:
+			fmt.Fprintf(w, "%s\tunmonitored\t-\t-\t-\t-\n", row)
+			continue
+		}
+		names := make([]string, 0, len(n.Events))
+		for name := range n.Events {
+			if spikes, _ := n.spikesSince(name, cutoff); spikes > 0 {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			fmt.Fprintf(w, "%s\tok\t-\t-\t-\t-\n", row)
+			continue
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			spikes, max := n.spikesSince(name, cutoff)
+			fmt.Fprintf(w, "%s\tspikes\t%s\t%d\t%d\t%d\n", row, name, n.Events[name].Latest, max, spikes)
+		}
+	}
+	nodesLock.RUnlock()
+	w.Flush()
+}
+
+var roleOrder = map[string]int{RoleMaster: 0, RoleReplica: 1, RoleSentinel: 2}
+
+// nodesCommand lists the nodes of the topology without dialing them
+func nodesCommand(args []string) int {
+	if _, ok := commandSetup("nodes", args); !ok {
+		return 2
+	}
+	srcs := loadSources(nil, true)
+	status := 0
+	for _, src := range srcs {
+		if src.Error != "" {
+			fmt.Fprintf(os.Stderr, "Unable to load %s: %s\n", src.Name, src.Error)
+			status = 1
+		}
+	}
+	pods, conflicts := mergeSources(srcs)
+	for _, conflict := range conflicts {
+		fmt.Fprintln(os.Stderr, conflict.String())
+	}
+	var specs []NodeSpec
+	for _, spec := range buildTopology(pods, sourceSentinels(srcs)) {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		if specs[i].Pod.Name != specs[j].Pod.Name {
+			return specs[i].Pod.Name < specs[j].Pod.Name
+		}
+		if specs[i].Role != specs[j].Role {
+			return roleOrder[specs[i].Role] < roleOrder[specs[j].Role]
+		}
+		return specs[i].Name < specs[j].Name
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPOD\tROLE")
+	for _, spec := range specs {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", spec.Name, spec.Pod.Name, spec.Role)
+	}
+	w.Flush()
+	return status
+}
+
+// historyCommand prints the latency history of an event on a node, from the
+// data store if one is configured and from the node otherwise
+func historyCommand(args []string) int {
+	rest, ok := commandSetup("history", args, "<node>", "<event>")
+	if !ok {
+		return 2
+	}
+	nodename, event := rest[0], rest[1]
+	var samples []LatencySample
+	var err error
+	if store != nil {
+		samples, err = store.GetInstanceEvents(nodename, event)
+	} else {
+		var conn *client.Redis
+		conn, err = dialNode(nodename)
+		if err == nil {
+			samples, err = getLatencyHistory(conn, event)
+			conn.ClosePool()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get the %s history of %s: %s\n", event, nodename, err.Error())
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tLATENCY(ms)")
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s\t%d\n", time.Unix(sample.Timestamp, 0).Format(time.RFC3339), sample.Latency)
+	}
+	w.Flush()
+	return 0
+}
+
+// doctorCommand prints the LATENCY DOCTOR report and latest events of a node
+func doctorCommand(args []string) int {
+	rest, ok := commandSetup("doctor", args, "<node>")
+	if !ok {
+		return 2
+	}
+	conn, err := dialNode(rest[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to %s: %s\n", rest[0], err.Error())
+		return 1
+	}
+	defer conn.ClosePool()
+	doctor, err := getLatencyDoctor(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get LATENCY DOCTOR from %s: %s\n", rest[0], err.Error())
+		return 1
+	}
+	fmt.Println(strings.TrimSpace(doctor))
+	latest, err := getLatencyLatest(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get LATENCY LATEST from %s: %s\n", rest[0], err.Error())
+		return 1
+	}
+	if len(latest) == 0 {
+		return 0
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EVENT\tTIME\tLATEST(ms)\tMAX(ms)")
+	for _, event := range latest {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", event.Name, time.Unix(event.Timestamp, 0).Format(time.RFC3339), event.Latest, event.Max)
+	}
+	w.Flush()
+	return 0
+}
+
+// dialNode connects to a node by address with the auth-pass of its pod if it
+// is in the topology, config.RedisAuthToken otherwise
+func dialNode(nodename string) (*client.Redis, error) {
+	password := config.RedisAuthToken
+	pods, _ := mergeSources(loadSources(nil, true))
+	spec, exists := buildTopology(pods, nil)[nodename]
+	if exists && spec.Pod.AuthToken != "" {
+		password = spec.Pod.AuthToken
+	}
+	return client.DialWithConfig(&client.DialConfig{Address: nodename, Password: password, Timeout: config.NodeTimeout})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	spikedAt := func(ago time.Duration) *Node {
+		ts := now.Add(-ago).Unix()
+		return &Node{
+			Name:    "10.0.0.1:6379",
+			Events:  map[string]LatencyEvent{"fork": {Name: "fork", Timestamp: ts, Latest: 300, Max: 300}},
+			History: map[string][]LatencySample{"fork": {{Timestamp: ts, Latency: 300}}},
+		}
+	}
+	tests := []struct {
+		name    string
+		results []pollResult
+		want    int
+	}{
+		{name: "no events", results: []pollResult{{Node: &Node{Name: "10.0.0.1:6379"}}}, want: checkOK},
+		{name: "event older than the window", results: []pollResult{{Node: spikedAt(time.Hour)}}, want: checkOK},
+		{name: "event within the window", results: []pollResult{{Node: spikedAt(time.Minute)}}, want: checkSpikes},
+		{name: "failed node", results: []pollResult{{Node: &Node{Name: "10.0.0.2:6379"}, Err: errors.New("connection refused")}}, want: checkFailed},
+		{
+			name: "spikes win over a failed node",
+			results: []pollResult{
+				{Node: &Node{Name: "10.0.0.2:6379"}, Err: errors.New("connection refused")},
+				{Node: spikedAt(time.Minute)},
+			},
+			want: checkSpikes,
+		},
+	}
+	for _, tt := range tests {
+		got := checkStatus(tt.results, 5*time.Minute, now)
+		if got != tt.want {
+			t.Errorf("%s: checkStatus = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
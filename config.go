@@ -0,0 +1,338 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// maskedSecret replaces secrets when the config is dumped
+const maskedSecret = "********"
+
+// ValidationError lists every problem found with a LaunchConfig
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(v, "\n  ")
+}
+
+// LoadConfigFile reads the YAML config file into cfg. Unknown keys are an
+// error so a misspelled setting isn't silently ignored.
+func LoadConfigFile(filename string, cfg *LaunchConfig) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to parse %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// stringList is a comma separated list flag
+type stringList struct {
+	list *[]string
+}
+
+func (s stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s stringList) Set(value string) error {
+	*s.list = strings.Split(value, ",")
+	return nil
+}
+
+// configFlags returns a flag set whose flags override the fields of cfg
+func configFlags(name string, cfg *LaunchConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile, "YAML config `file`")
+	fs.StringVar(&cfg.SentinelConfigFile, "sentinel-config", cfg.SentinelConfigFile, "sentinel config `file`")
+	fs.Var(stringList{&cfg.SentinelConfigFiles}, "sentinel-configs", "comma separated sentinel config files, directories or globs")
+	fs.Var(stringList{&cfg.SentinelAddresses}, "sentinels", "comma separated live sentinel `addresses`")
+	fs.BoolVar(&cfg.MonitorSentinels, "monitor-sentinels", cfg.MonitorSentinels, "monitor the sentinels as well")
+	fs.IntVar(&cfg.LatencyThreshold, "threshold", cfg.LatencyThreshold, "latency-monitor-threshold in `ms`")
+	fs.BoolVar(&cfg.ObserveOnly, "observe-only", cfg.ObserveOnly, "never change the config of a node")
+	fs.DurationVar(&cfg.PollInterval, "poll-interval", cfg.PollInterval, "how often each node is polled")
+	fs.IntVar(&cfg.PollConcurrency, "concurrency", cfg.PollConcurrency, "number of nodes polled at once")
+	fs.DurationVar(&cfg.NodeTimeout, "node-timeout", cfg.NodeTimeout, "how long a node poll may take")
+	fs.StringVar(&cfg.HTTPListen, "listen", cfg.HTTPListen, "`address` to serve the HTTP API on")
+	fs.StringVar(&cfg.AlertConfigFile, "alert-config", cfg.AlertConfigFile, "alert config `file`")
+	fs.StringVar(&cfg.LatencyHarvestMode, "harvest-mode", cfg.LatencyHarvestMode, "latency harvest mode, watermark or reset")
+	return fs
+}
+
+// loadLaunchConfig builds the configuration from the config file, the
+// CANDUI_* environment variables and the flags in args, each overriding the
+// one before, then validates it and fills in defaults. The arguments left
+// after the flags are returned. A command can add flags of its own with
+// extra, which is called on every flag set used.
+func loadLaunchConfig(name string, args []string, extra ...func(*flag.FlagSet)) (cfg LaunchConfig, rest []string, err error) {
+	flags := func(cfg *LaunchConfig) *flag.FlagSet {
+		fs := configFlags(name, cfg)
+		for _, add := range extra {
+			add(fs)
+		}
+		return fs
+	}
+	// the flags are parsed once to find the config file and again once the
+	// file and environment are loaded so they take precedence
+	var first LaunchConfig
+	fs := flags(&first)
+	fs.SetOutput(ioutil.Discard)
+	err = fs.Parse(args)
+	if err == flag.ErrHelp {
+		flags(&first).PrintDefaults()
+		return cfg, rest, err
+	}
+	if err != nil {
+		return cfg, rest, err
+	}
+	filename := first.ConfigFile
+	if filename == "" {
+		filename = os.Getenv("CANDUI_CONFIGFILE")
+	}
+	if filename != "" {
+		err = LoadConfigFile(filename, &cfg)
+		if err != nil {
+			return cfg, rest, err
+		}
+	}
+	err = envconfig.Process("candui", &cfg)
+	if err != nil {
+		return cfg, rest, err
+	}
+	fs = flags(&cfg)
+	err = fs.Parse(args)
+	if err != nil {
+		return cfg, rest, err
+	}
+	cfg.ConfigFile = filename
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, fs.Args(), err
+	}
+	cfg.setDefaults()
+	return cfg, fs.Args(), nil
+}
+
+// Validate checks the config, returning a ValidationError listing every
+// problem found. An alert config file is loaded into Alerts.
+func (c *LaunchConfig) Validate() error {
+	var problems ValidationError
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkAddress := func(field, addr string) {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			fail("%s: %q is not a host:port address", field, addr)
+		}
+	}
+	for field, value := range map[string]int64{
+		"latency_threshold":      int64(c.LatencyThreshold),
+		"poll_concurrency":       int64(c.PollConcurrency),
+		"node_timeout":           int64(c.NodeTimeout),
+		"poll_interval":          int64(c.PollInterval),
+		"slowlog_count":          int64(c.SlowlogCount),
+		"slowlog_max_args":       int64(c.SlowlogMaxArgs),
+		"slowlog_max_arg_length": int64(c.SlowlogMaxArgLength),
+		"replication_lag_bytes":  c.ReplicationLagBytes,
+	} {
+		if value < 0 {
+			fail("%s: must not be negative", field)
+		}
+	}
+	for pod, interval := range c.PodIntervals {
+		if interval <= 0 {
+			fail("pod_intervals: interval for %s must be positive", pod)
+		}
+	}
+	for pod, threshold := range c.PodThresholds {
+		if threshold < 0 {
+			fail("pod_thresholds: threshold for %s must not be negative", pod)
+		}
+	}
+	nodeThresholds := make(map[string]int)
+	for node, threshold := range c.NodeThresholds {
+		// host:port is accepted in the file, the env can only use host/port
+		key := strings.Replace(node, ":", "/", 1)
+		if threshold < 0 {
+			fail("node_thresholds: threshold for %s must not be negative", node)
+		}
+		checkAddress("node_thresholds", strings.Replace(key, "/", ":", 1))
+		nodeThresholds[key] = threshold
+	}
+	if c.NodeThresholds != nil {
+		c.NodeThresholds = nodeThresholds
+	}
+	for _, addr := range c.SentinelAddresses {
+		checkAddress("sentinel_addresses", addr)
+	}
+	for _, addr := range c.StoreSentinels {
+		checkAddress("store_sentinels", addr)
+	}
+	if c.StoreAddress != "" {
+		checkAddress("store_address", c.StoreAddress)
+	}
+	if c.StoreAddress != "" && len(c.StoreSentinels) > 0 {
+		fail("store_address and store_sentinels can't both be set")
+	}
+	if len(c.StoreSentinels) > 0 && c.StorePodName == "" {
+		fail("store_sentinels: store_pod_name is required to find the store master")
+	}
+	switch c.LatencyHarvestMode {
+	case "", HarvestWatermark:
+	case HarvestReset:
+		if c.StoreAddress == "" && len(c.StoreSentinels) == 0 {
+			fail("latency_harvest_mode: %s needs a data store", HarvestReset)
+		}
+		if c.ObserveOnly {
+			fail("latency_harvest_mode: %s is not allowed in observe-only mode", HarvestReset)
+		}
+	default:
+		fail("latency_harvest_mode: unknown mode %q, use %s or %s", c.LatencyHarvestMode, HarvestWatermark, HarvestReset)
+	}
+	if c.AlertConfigFile != "" && c.Alerts != nil {
+		fail("alert_config_file and alerts can't both be set")
+	} else if c.AlertConfigFile != "" {
+		ac, err := LoadAlertConfig(c.AlertConfigFile)
+		if err != nil {
+			fail("alert_config_file: %s", err.Error())
+		} else {
+			c.Alerts = &ac
+		}
+	} else if c.Alerts != nil {
+		err := c.Alerts.prepare()
+		if err != nil {
+			fail("alerts: %s", err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return problems
+	}
+	return nil
+}
+
+// setDefaults fills in every setting left unset
+func (c *LaunchConfig) setDefaults() {
+	if c.SentinelConfigFile == "" && len(c.SentinelConfigFiles) == 0 && len(c.SentinelAddresses) == 0 {
+		c.SentinelConfigFile = "/etc/redis/sentinel.conf"
+	}
+	if c.LatencyThreshold == 0 {
+		c.LatencyThreshold = 50
+	}
+	if c.PollConcurrency == 0 {
+		c.PollConcurrency = 16
+	}
+	if c.NodeTimeout == 0 {
+		c.NodeTimeout = 10 * time.Second
+	}
+	if c.SlowlogCount == 0 {
+		c.SlowlogCount = 128
+	}
+	if c.SlowlogMaxArgs == 0 {
+		c.SlowlogMaxArgs = 16
+	}
+	if c.SlowlogMaxArgLength == 0 {
+		c.SlowlogMaxArgLength = 64
+	}
+	if c.ReplicationLagBytes == 0 {
+		c.ReplicationLagBytes = 1024 * 1024
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 60 * time.Second
+	}
+	if c.LatencyHarvestMode == "" {
+		c.LatencyHarvestMode = HarvestWatermark
+	}
+}
+
+// maskURL masks the userinfo and query of a URL, where webhook credentials
+// and tokens are usually carried. A URL which can't be parsed is masked
+// whole.
+func maskURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return maskedSecret
+	}
+	hasUser := u.User != nil
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = maskedSecret
+	}
+	masked := u.String()
+	if hasUser {
+		// url.User would escape the mask
+		masked = strings.Replace(masked, "//", "//"+maskedSecret+"@", 1)
+	}
+	return masked
+}
+
+// masked returns a copy of the config with its secrets masked
+func (c LaunchConfig) masked() LaunchConfig {
+	mask := func(secret *string) {
+		if *secret != "" {
+			*secret = maskedSecret
+		}
+	}
+	mask(&c.RedisAuthToken)
+	mask(&c.StoreAuthToken)
+	if c.Alerts != nil {
+		alerts := *c.Alerts
+		if alerts.SMTP != nil {
+			smtp := *alerts.SMTP
+			mask(&smtp.Password)
+			alerts.SMTP = &smtp
+		}
+		alerts.Webhooks = make([]string, len(c.Alerts.Webhooks))
+		for i, hook := range c.Alerts.Webhooks {
+			alerts.Webhooks[i] = maskURL(hook)
+		}
+		c.Alerts = &alerts
+	}
+	return c
+}
+
+// configCommand validates (check) or prints (dump) the configuration
+func configCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "dump") {
+		fmt.Fprintln(os.Stderr, "usage: candui config check|dump [flags]")
+		return 2
+	}
+	cfg, _, err := loadLaunchConfig("candui config "+args[0], args[1:])
+	if args[0] == "dump" {
+		out, merr := yaml.Marshal(cfg.masked())
+		if merr != nil {
+			fmt.Fprintln(os.Stderr, merr.Error())
+			return 1
+		}
+		os.Stdout.Write(out)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if args[0] == "check" {
+		source := "defaults and environment"
+		if cfg.ConfigFile != "" {
+			source = cfg.ConfigFile
+		}
+		fmt.Println("Configuration from " + source + " is valid")
+	}
+	return 0
+}
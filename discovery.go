@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// sentinelConns holds the connections to the sentinels used for discovery
+var sentinelConns = make(map[string]*client.Redis)
+
+func sentinelConn(addr string) (*client.Redis, error) {
+	conn, exists := sentinelConns[addr]
+	if exists {
+		return conn, nil
+	}
+	conn, err := client.DialWithConfig(&client.DialConfig{Address: addr, Timeout: config.NodeTimeout})
+	if err != nil {
+		return nil, err
+	}
+	sentinelConns[addr] = conn
+	return conn, nil
+}
+
+func dropSentinelConn(addr string) {
+	conn, exists := sentinelConns[addr]
+	if exists {
+		conn.ClosePool()
+		delete(sentinelConns, addr)
+	}
+}
+
+// sentinelQuery runs a SENTINEL subcommand which returns a list of flattened
+// field/value arrays, such as SENTINEL MASTERS, and returns them as maps.
+func sentinelQuery(conn *client.Redis, args ...interface{}) (results []map[string]string, err error) {
+	rp, err := conn.ExecuteCommand(append([]interface{}{"SENTINEL"}, args...)...)
+	if err != nil {
+		return results, err
+	}
+	entries, err := rp.MultiValue()
+	if err != nil {
+		return results, err
+	}
+	for _, entry := range entries {
+		fields, err := entry.HashValue()
+		if err != nil {
+			return results, err
+		}
+		results = append(results, fields)
+	}
+	return results, nil
+}
+
+// discoverFromSentinel builds the pod configs known to the sentinel at addr
+// by calling SENTINEL MASTERS, REPLICAS and SENTINELS.
+func discoverFromSentinel(addr string) (pods map[string]SentinelPodConfig, err error) {
+	conn, err := sentinelConn(addr)
+	if err != nil {
+		return pods, err
+	}
+	masters, err := sentinelQuery(conn, "MASTERS")
+	if err != nil {
+		dropSentinelConn(addr)
+		return pods, err
+	}
+	pods = make(map[string]SentinelPodConfig)
+	for _, master := range masters {
+		port, _ := strconv.Atoi(master["port"])
+		quorum, _ := strconv.Atoi(master["quorum"])
+		epoch, _ := strconv.ParseInt(master["config-epoch"], 10, 64)
+		pod := SentinelPodConfig{
+			Name:        master["name"],
+			IP:          master["ip"],
+			Port:        port,
+			Quorum:      quorum,
+			AuthToken:   config.RedisAuthToken,
+			Sentinels:   make(map[string]string),
+			ConfigEpoch: epoch,
+		}
+		replicas, err := sentinelQuery(conn, "REPLICAS", pod.Name)
+		if err != nil {
+			// Sentinels older than 5.0 only know SLAVES
+			replicas, err = sentinelQuery(conn, "SLAVES", pod.Name)
+			if err != nil {
+				return pods, err
+			}
+		}
+		for _, replica := range replicas {
+			pod.KnownReplicas = append(pod.KnownReplicas, fmt.Sprintf("%s:%s", replica["ip"], replica["port"]))
+		}
+		sentinels, err := sentinelQuery(conn, "SENTINELS", pod.Name)
+		if err != nil {
+			return pods, err
+		}
+		for _, sentinel := range sentinels {
+			pod.Sentinels[fmt.Sprintf("%s:%s", sentinel["ip"], sentinel["port"])] = sentinel["runid"]
+		}
+		// the queried sentinel doesn't list itself
+		pod.Sentinels[addr] = ""
+		pods[pod.Name] = pod
+	}
+	return pods, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// reportInfoSections are the INFO sections captured in a DiagnosticReport
+var reportInfoSections = []string{"persistence", "memory", "stats"}
+
+// DiagnosticReport is the context captured from a node when it starts
+// showing latency spikes.
+type DiagnosticReport struct {
+	Timestamp int64
+	Doctor    string
+	Latest    []LatencyEvent
+	Info      map[string]string
+}
+
+// getLatencyDoctor returns the LATENCY DOCTOR report of the node
+func getLatencyDoctor(conn *client.Redis) (string, error) {
+	rp, err := conn.ExecuteCommand("LATENCY", "DOCTOR")
+	if err != nil {
+		return "", err
+	}
+	return rp.StringValue()
+}
+
+// getInfoSection returns the raw INFO output for a section
+func getInfoSection(conn *client.Redis, section string) (string, error) {
+	rp, err := conn.ExecuteCommand("INFO", section)
+	if err != nil {
+		return "", err
+	}
+	return rp.StringValue()
+}
+
+// captureDiagnostics collects LATENCY DOCTOR, LATENCY LATEST and the
+// reportInfoSections from the node. A section which can't be fetched is
+// recorded with the error rather than failing the report.
+func captureDiagnostics(conn *client.Redis) (report DiagnosticReport, err error) {
+	report.Timestamp = time.Now().Unix()
+	report.Doctor, err = getLatencyDoctor(conn)
+	if err != nil {
+		return report, err
+	}
+	report.Latest, err = getLatencyLatest(conn)
+	if err != nil {
+		return report, err
+	}
+	report.Info = make(map[string]string)
+	for _, section := range reportInfoSections {
+		info, err := getInfoSection(conn, section)
+		if err != nil {
+			info = "ERROR: " + err.Error()
+		}
+		report.Info[section] = strings.TrimSpace(info)
+	}
+	return report, nil
+}
+
+// diagnoseNode captures a DiagnosticReport for the node, keeps it on the node
+// and stores it alongside the node's events.
+func (n *Node) diagnoseNode() {
+	conn, err := n.conn()
+	if err != nil {
+		return
+	}
+	report, err := captureDiagnostics(conn)
+	if err != nil {
+		logger.Warning(n.Name + " - unable to capture latency diagnostics: " + err.Error())
+		return
+	}
+	nodesLock.Lock()
+	n.LastReport = &report
+	nodesLock.Unlock()
+	annotate(n.Name, "latency-doctor", "latency spikes started, diagnostics captured")
+	if store != nil {
+		err = store.StoreReport(n.Name, report)
+		if err != nil {
+			logger.Warning(n.Name + " - unable to persist latency diagnostics: " + err.Error())
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"time"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/therealbill/libredis/client"
 )
@@ -15,78 +19,207 @@ type SentinelStore struct {
 	RedisAuth     string
 	PodName       string
 	MasterAddress string
+
+	// lock guards Master and MasterAddress, the store is shared by the
+	// poll workers
+	lock sync.Mutex
 }
 
+// DataStore is where candui persists the samples it harvests so they outlive
+// the in-memory buffers Redis keeps.
 type DataStore interface {
-	ConnectMaster() error
-	StoreEventEntry(instance, event string, value int) error
-	GetInstanceEvent(instance, event string) (int, error)
+	ConnectMaster() (*client.Redis, error)
+	StoreEventEntry(instance, event string, timestamp, value int64) error
+	GetInstanceEvents(instance, event string) ([]LatencySample, error)
+	StoreAnnotation(instance string, a Annotation) error
+	StoreReport(instance string, r DiagnosticReport) error
+	StoreSlowlogEntry(instance string, e SlowlogEntry) error
+	StoreMetric(instance, metric string, timestamp int64, value float64) error
+}
+
+// store is the configured DataStore, nil if persistence is not configured
+var store DataStore
+
+// NewDataStore builds the DataStore described by the launch config. It
+// returns nil if no store has been configured.
+func NewDataStore(cfg LaunchConfig) DataStore {
+	if cfg.StoreAddress == "" && len(cfg.StoreSentinels) == 0 {
+		return nil
+	}
+	return &SentinelStore{
+		SentinelHosts: cfg.StoreSentinels,
+		UseSentinel:   len(cfg.StoreSentinels) > 0,
+		RedisAuth:     cfg.StoreAuthToken,
+		PodName:       cfg.StorePodName,
+		MasterAddress: cfg.StoreAddress,
+	}
 }
 
 func (d *SentinelStore) ConnectSentinel() (error, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.connectSentinel()
+}
+
+// connectSentinel looks up the store master from the sentinels and dials it.
+// The caller must hold d.lock.
+func (d *SentinelStore) connectSentinel() (error, bool) {
 	if !d.UseSentinel {
 		return nil, false
 	}
-	haveconn := false
+	var lasterr error
 	for _, addr := range d.SentinelHosts {
-		conn, err := client.DialWithConfig(&client.DialConfig{Address: addr})
+		conn, err := client.DialWithConfig(&client.DialConfig{Address: addr, Timeout: config.NodeTimeout})
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		master, err := conn.SentinelGetMaster(d.PodName)
+		conn.ClosePool()
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		d.MasterAddress = fmt.Sprintf("%s:%d", master.Host, master.Port)
+		d.Master, err = client.DialWithConfig(&client.DialConfig{Address: d.MasterAddress, Password: d.RedisAuth, Timeout: config.NodeTimeout})
 		if err != nil {
+			lasterr = err
 			continue
-		} else {
-			master, err := conn.SentinelGetMaster(d.PodName)
+		}
+		logger.Info("Data store master is " + d.MasterAddress)
+		return nil, true
+	}
+	return lasterr, false
+}
+
+// ConnectMaster returns the connection to the store master, dialing it if
+// there is none. A connection which fails a command is dropped by the store
+// methods, so it is redialed on the next call instead of being checked
+// before every use.
+func (d *SentinelStore) ConnectMaster() (master *client.Redis, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.Master != nil {
+		return d.Master, nil
+	}
+	if d.UseSentinel {
+		err, ok := d.connectSentinel()
+		if !ok {
 			if err == nil {
-				logger.Info(fmt.Sprintf("%+v", master))
-				return nil, true
+				err = fmt.Errorf("No master has been pulled from Sentinels")
 			}
+			return nil, err
 		}
+		return d.Master, nil
 	}
-	return nil, haveconn
+	d.Master, err = client.DialWithConfig(&client.DialConfig{Address: d.MasterAddress, Password: d.RedisAuth, Timeout: config.NodeTimeout})
+	if err != nil {
+		d.Master = nil
+	}
+	return d.Master, err
 }
 
-func (d *SentinelStore) testMasterConn() bool {
-	err := d.Master.Ping()
-	if err != nil {
-		return true
+// dropMaster closes the master connection if it is still conn, so the next
+// ConnectMaster redials, possibly to a new master after a failover.
+func (d *SentinelStore) dropMaster(conn *client.Redis) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.Master == conn {
+		d.Master.ClosePool()
+		d.Master = nil
 	}
-	return false
 }
 
-func (d *SentinelStore) ConnectMaster() (master *client.Redis, err error) {
-	if d.Master == nil {
-		err = fmt.Errorf("No master has been pulled from Sentinels")
-		return
+// do runs f against the master, dropping the connection if f fails
+func (d *SentinelStore) do(f func(conn *client.Redis) error) error {
+	conn, err := d.ConnectMaster()
+	if err != nil {
+		return err
 	}
-	if d.UseSentinel {
-		if d.Master == nil {
-			d.ConnectSentinel()
+	err = f(conn)
+	if err != nil {
+		d.dropMaster(conn)
+	}
+	return err
+}
+
+func eventKeyName(instance, event string) string {
+	return "_latency:i" + instance + ":" + event
+}
+
+// StoreEventEntry records a latency sample for the instance/event. Samples are
+// scored by their timestamp and any existing entry for the same timestamp is
+// replaced, so storing an overlapping history window never duplicates points.
+func (d *SentinelStore) StoreEventEntry(instance, event string, timestamp, value int64) error {
+	keyname := eventKeyName(instance, event)
+	return d.do(func(conn *client.Redis) error {
+		_, err := conn.ExecuteCommand("ZREMRANGEBYSCORE", keyname, timestamp, timestamp)
+		if err != nil {
+			return err
 		}
+		_, err = conn.ZAdd(keyname, float64(timestamp), fmt.Sprintf("%d:%d", timestamp, value))
+		return err
+	})
+}
 
-		if d.testMasterConn() {
-			return d.Master, nil
+func (d *SentinelStore) GetInstanceEvents(instance, event string) (results []LatencySample, err error) {
+	var res []string
+	err = d.do(func(conn *client.Redis) (err error) {
+		res, err = conn.ZRange(eventKeyName(instance, event), 0, -1, false)
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+	for _, member := range res {
+		parts := strings.SplitN(member, ":", 2)
+		if len(parts) != 2 {
+			continue
 		}
+		ts, _ := strconv.ParseInt(parts[0], 10, 64)
+		val, _ := strconv.ParseInt(parts[1], 10, 64)
+		results = append(results, LatencySample{Timestamp: ts, Latency: val})
 	}
-	return d.Master, nil
+	sort.Slice(results, func(i, j int) bool { return results[i].Timestamp < results[j].Timestamp })
+	return results, nil
 }
 
-func (d *SentinelStore) StoreEventEntry(instance, event, value string) error {
-	conn, err := d.ConnectMaster()
+// zadd adds a member to a sorted set on the master
+func (d *SentinelStore) zadd(key string, score float64, member string) error {
+	return d.do(func(conn *client.Redis) error {
+		_, err := conn.ZAdd(key, score, member)
+		return err
+	})
+}
+
+// StoreAnnotation records an annotation for the instance in the sorted set
+// "_annotations:i<instance>", scored by its timestamp.
+func (d *SentinelStore) StoreAnnotation(instance string, a Annotation) error {
+	return d.zadd("_annotations:i"+instance, float64(a.Timestamp), fmt.Sprintf("%d:%s:%s", a.Timestamp, a.Event, a.Text))
+}
+
+// StoreReport records a diagnostic report for the instance as JSON in the
+// sorted set "_reports:i<instance>", scored by its timestamp.
+func (d *SentinelStore) StoreReport(instance string, r DiagnosticReport) error {
+	data, err := json.Marshal(r)
 	if err != nil {
 		return err
 	}
-	keyname := "_latency:i" + instance + ":" + event
-	now := time.Now().Unix()
-	res, err := conn.ZAdd(keyname, float64(now), value)
-	fmt.Printf("%+v\n", res)
-	return err
+	return d.zadd("_reports:i"+instance, float64(r.Timestamp), string(data))
 }
 
-func (d *SentinelStore) GetInstanceEvents(instance, event string) (results []int, err error) {
-	conn, err := d.ConnectMaster()
+// StoreSlowlogEntry records a slowlog entry for the instance as JSON in the
+// sorted set "_slowlog:i<instance>", scored by its timestamp.
+func (d *SentinelStore) StoreSlowlogEntry(instance string, e SlowlogEntry) error {
+	data, err := json.Marshal(e)
 	if err != nil {
-		return results, err
+		return err
 	}
-	keyname := "_latency:i" + instance + ":" + event
-	res, err := conn.ZRange(keyname, 0, -1, true)
-	fmt.Printf("%+v\n", res)
-	return results, err
+	return d.zadd("_slowlog:i"+instance, float64(e.Timestamp), string(data))
+}
+
+// StoreMetric records a metric value for the instance in the sorted set
+// "_metrics:i<instance>:<metric>", scored by its timestamp.
+func (d *SentinelStore) StoreMetric(instance, metric string, timestamp int64, value float64) error {
+	return d.zadd("_metrics:i"+instance+":"+metric, float64(timestamp), fmt.Sprintf("%d:%g", timestamp, value))
 }
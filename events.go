@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// Annotation is a notable event recorded against a node, such as a failover,
+// so it can be correlated with the latency data.
+type Annotation struct {
+	Timestamp int64
+	Event     string
+	Text      string
+}
+
+// maxAnnotations is the number of annotations kept in memory per node
+const maxAnnotations = 100
+
+// sentinelEventChannels are the sentinel pub/sub channels candui follows
+var sentinelEventChannels = []string{"+switch-master", "+sdown", "-sdown", "+odown", "-odown", "+slave"}
+
+// sentinelWatcher follows the events of one sentinel until it is stopped
+type sentinelWatcher struct {
+	addr string
+	stop chan struct{}
+	// ps is the current subscription, closed to stop the watcher
+	ps   *client.PubSub
+	lock sync.Mutex
+}
+
+var sentinelWatchers = make(map[string]*sentinelWatcher)
+var sentinelWatchersLock sync.Mutex
+
+// annotate records an annotation on the named node and persists it if a data
+// store is configured.
+func annotate(nodename, event, text string) {
+	a := Annotation{Timestamp: time.Now().Unix(), Event: event, Text: text}
+	logger.Info(fmt.Sprintf("%s - %s %s", nodename, event, text))
+	nodesLock.Lock()
+	node, exists := Nodes[nodename]
+	if exists {
+		node.Annotations = append(node.Annotations, a)
+		if len(node.Annotations) > maxAnnotations {
+			node.Annotations = node.Annotations[len(node.Annotations)-maxAnnotations:]
+		}
+	}
+	nodesLock.Unlock()
+	if store != nil {
+		err := store.StoreAnnotation(nodename, a)
+		if err != nil {
+			logger.Warning(nodename + " - unable to persist annotation: " + err.Error())
+		}
+	}
+}
+
+// sentinelEventSources returns the sentinels whose events should be followed:
+// the live sentinels and the sentinels the config files belong to.
+func sentinelEventSources() []string {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	return sourceSentinels(sources)
+}
+
+// ensureSentinelWatchers starts an event watcher for every sentinel source
+// that doesn't have one yet and stops the watchers of sentinels which are no
+// longer a source.
+func ensureSentinelWatchers() {
+	sentinelWatchersLock.Lock()
+	defer sentinelWatchersLock.Unlock()
+	wanted := make(map[string]bool)
+	for _, addr := range sentinelEventSources() {
+		wanted[addr] = true
+		if sentinelWatchers[addr] != nil {
+			continue
+		}
+		w := &sentinelWatcher{addr: addr, stop: make(chan struct{})}
+		sentinelWatchers[addr] = w
+		go w.watch()
+	}
+	for addr, w := range sentinelWatchers {
+		if !wanted[addr] {
+			w.Stop()
+			delete(sentinelWatchers, addr)
+		}
+	}
+}
+
+// Stop ends the watcher, closing its subscription if it has one
+func (w *sentinelWatcher) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	close(w.stop)
+	if w.ps != nil {
+		w.ps.Close()
+	}
+}
+
+func (w *sentinelWatcher) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch subscribes to the event channels of the sentinel and applies the
+// events as they arrive, resubscribing if the connection drops, until the
+// watcher is stopped.
+func (w *sentinelWatcher) watch() {
+	for {
+		err := w.follow()
+		if w.stopped() {
+			logger.Info("Stopped following sentinel events from " + w.addr)
+			return
+		}
+		logger.Warning("Lost sentinel event subscription to " + w.addr + ": " + err.Error())
+		select {
+		case <-w.stop:
+			logger.Info("Stopped following sentinel events from " + w.addr)
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (w *sentinelWatcher) follow() error {
+	conn, err := client.DialWithConfig(&client.DialConfig{Address: w.addr, Timeout: config.NodeTimeout})
+	if err != nil {
+		return err
+	}
+	defer conn.ClosePool()
+	ps, err := conn.PubSub()
+	if err != nil {
+		return err
+	}
+	defer ps.Close()
+	w.lock.Lock()
+	if w.stopped() {
+		w.lock.Unlock()
+		return nil
+	}
+	w.ps = ps
+	w.lock.Unlock()
+	err = ps.Subscribe(sentinelEventChannels...)
+	if err != nil {
+		return err
+	}
+	logger.Info("Following sentinel events from " + w.addr)
+	for {
+		msg, err := ps.Receive()
+		if err != nil || w.stopped() {
+			return err
+		}
+		if len(msg) < 3 || msg[0] != "message" {
+			continue
+		}
+		handleSentinelEvent(msg[1], msg[2])
+	}
+}
+
+// handleSentinelEvent applies a sentinel event to the node set
+func handleSentinelEvent(channel, payload string) {
+	fields := strings.Fields(payload)
+	switch channel {
+	case "+switch-master":
+		// <name> <old ip> <old port> <new ip> <new port>
+		if len(fields) < 5 {
+			return
+		}
+		switchMaster(fields[0], fields[1]+":"+fields[2], fields[3], fields[4])
+	case "+sdown", "-sdown", "+odown", "-odown":
+		// <type> <name> <ip> <port> [@ <master name> <master ip> <master port>]
+		if len(fields) < 4 {
+			return
+		}
+		nodename := fields[2] + ":" + fields[3]
+		status := ""
+		if channel[0] == '+' {
+			status = channel[1:]
+		}
+		nodesLock.Lock()
+		node, exists := Nodes[nodename]
+		if exists {
+			node.SentinelStatus = status
+		}
+		nodesLock.Unlock()
+		annotate(nodename, channel, payload)
+	case "+slave":
+		// slave <ip>:<port> <ip> <port> @ <master name> <master ip> <master port>
+		if len(fields) < 6 || fields[4] != "@" {
+			return
+		}
+		nodename := fields[2] + ":" + fields[3]
+		pod, exists := podConfig(fields[5])
+		if !exists {
+			return
+		}
+		loadNodes(map[string]NodeSpec{nodename: {Name: nodename, Pod: pod, Role: RoleReplica}})
+		annotate(nodename, channel, payload)
+	}
+}
+
+// podConfig returns the pod config currently held by a node in the pod
+func podConfig(podname string) (pod SentinelPodConfig, exists bool) {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	for _, node := range Nodes {
+		if node.Pod.Name == podname && node.State != NodeRemoved {
+			return node.Pod, true
+		}
+	}
+	return pod, false
+}
+
+// switchMaster updates the pod after a failover: the new master is promoted,
+// the old master demoted, and every node in the pod gets the new pod config.
+func switchMaster(podname, oldmaster, newip, newport string) {
+	pod, exists := podConfig(podname)
+	if !exists {
+		return
+	}
+	pod.IP = newip
+	pod.Port, _ = strconv.Atoi(newport)
+	newmaster := pod.Address()
+	specs := make(map[string]NodeSpec)
+	nodesLock.RLock()
+	for _, node := range Nodes {
+		if node.Pod.Name == podname && node.State != NodeRemoved {
+			specs[node.Name] = NodeSpec{Name: node.Name, Pod: pod, Role: node.Role}
+		}
+	}
+	nodesLock.RUnlock()
+	if spec, exists := specs[oldmaster]; exists {
+		spec.Role = RoleReplica
+		specs[oldmaster] = spec
+	}
+	specs[newmaster] = NodeSpec{Name: newmaster, Pod: pod, Role: RoleMaster}
+	loadNodes(specs)
+	text := fmt.Sprintf("pod %s failed over from %s to %s", podname, oldmaster, newmaster)
+	annotate(newmaster, "+switch-master", text)
+	annotate(oldmaster, "+switch-master", text)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// MemoryInfo holds the fields of INFO memory candui uses
+type MemoryInfo struct {
+	UsedMemory         int64
+	UsedMemoryRSS      int64
+	UsedMemoryPeak     int64
+	MaxMemory          int64
+	FragmentationRatio float64
+	MaxMemoryPolicy    string
+}
+
+// PersistenceInfo holds the fields of INFO persistence candui uses
+type PersistenceInfo struct {
+	Loading                  bool
+	RDBChangesSinceLastSave  int64
+	RDBBgsaveInProgress      bool
+	RDBLastSaveTime          int64
+	RDBLastBgsaveStatus      string
+	RDBLastBgsaveTimeSec     int64
+	RDBCurrentBgsaveTimeSec  int64
+	AOFEnabled               bool
+	AOFRewriteInProgress     bool
+	AOFRewriteScheduled      bool
+	AOFLastRewriteTimeSec    int64
+	AOFCurrentRewriteTimeSec int64
+	AOFLastBgrewriteStatus   string
+	AOFLastWriteStatus       string
+}
+
+// StatsInfo holds the fields of INFO stats candui uses
+type StatsInfo struct {
+	TotalConnectionsReceived int64
+	TotalCommandsProcessed   int64
+	InstantaneousOpsPerSec   int64
+	RejectedConnections      int64
+	SyncFull                 int64
+	SyncPartialOK            int64
+	SyncPartialErr           int64
+	ExpiredKeys              int64
+	EvictedKeys              int64
+	KeyspaceHits             int64
+	KeyspaceMisses           int64
+	LatestForkUsec           int64
+}
+
+// ReplicaInfo is a replica as listed in a master's INFO replication
+type ReplicaInfo struct {
+	Addr   string
+	State  string
+	Offset int64
+	Lag    int64
+}
+
+// ReplicationInfo holds the fields of INFO replication candui uses
+type ReplicationInfo struct {
+	Role                   string
+	ConnectedReplicas      int64
+	Replicas               []ReplicaInfo
+	MasterHost             string
+	MasterPort             int64
+	MasterLinkStatus       string
+	MasterLastIOSecondsAgo int64
+	MasterSyncInProgress   bool
+	SlaveReplOffset        int64
+	MasterReplOffset       int64
+}
+
+// ClientsInfo holds the fields of INFO clients candui uses
+type ClientsInfo struct {
+	ConnectedClients int64
+	BlockedClients   int64
+}
+
+// KeyspaceInfo is a database from INFO keyspace
+type KeyspaceInfo struct {
+	Keys    int64
+	Expires int64
+	AvgTTL  int64
+}
+
+// CommandStat is a command from INFO commandstats
+type CommandStat struct {
+	Calls       int64
+	Usec        int64
+	UsecPerCall float64
+}
+
+// RedisInfo is the typed form of a node's INFO output
+type RedisInfo struct {
+	Timestamp    time.Time
+	Memory       MemoryInfo
+	Persistence  PersistenceInfo
+	Stats        StatsInfo
+	Replication  ReplicationInfo
+	Clients      ClientsInfo
+	Keyspace     map[string]KeyspaceInfo
+	Commandstats map[string]CommandStat
+}
+
+// InfoRates are per second rates computed from two INFO snapshots
+type InfoRates struct {
+	CommandsPerSec            float64
+	KeyspaceHitsPerSec        float64
+	KeyspaceMissesPerSec      float64
+	EvictedKeysPerSec         float64
+	ExpiredKeysPerSec         float64
+	RejectedConnectionsPerSec float64
+	ConnectionsPerSec         float64
+	HitRatio                  float64
+}
+
+// parseInfoSections splits raw INFO output into its sections, keyed by the
+// lower cased section name.
+func parseInfoSections(raw string) map[string]map[string]string {
+	sections := make(map[string]map[string]string)
+	current := make(map[string]string)
+	sections[""] = current
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			current = make(map[string]string)
+			sections[name] = current
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			current[kv[0]] = kv[1]
+		}
+	}
+	return sections
+}
+
+// parseInfoFields splits a value such as "keys=1,expires=0" into its fields
+func parseInfoFields(value string) map[string]string {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
+
+func infoInt(fields map[string]string, name string) int64 {
+	v, _ := strconv.ParseInt(fields[name], 10, 64)
+	return v
+}
+
+func infoFloat(fields map[string]string, name string) float64 {
+	v, _ := strconv.ParseFloat(fields[name], 64)
+	return v
+}
+
+func infoBool(fields map[string]string, name string) bool {
+	return fields[name] == "1"
+}
+
+// ParseInfo parses raw INFO output into a RedisInfo
+func ParseInfo(raw string) RedisInfo {
+	sections := parseInfoSections(raw)
+	info := RedisInfo{Timestamp: time.Now(), Keyspace: make(map[string]KeyspaceInfo), Commandstats: make(map[string]CommandStat)}
+
+	f := sections["memory"]
+	info.Memory = MemoryInfo{
+		UsedMemory:         infoInt(f, "used_memory"),
+		UsedMemoryRSS:      infoInt(f, "used_memory_rss"),
+		UsedMemoryPeak:     infoInt(f, "used_memory_peak"),
+		MaxMemory:          infoInt(f, "maxmemory"),
+		FragmentationRatio: infoFloat(f, "mem_fragmentation_ratio"),
+		MaxMemoryPolicy:    f["maxmemory_policy"],
+	}
+
+	f = sections["persistence"]
+	info.Persistence = PersistenceInfo{
+		Loading:                  infoBool(f, "loading"),
+		RDBChangesSinceLastSave:  infoInt(f, "rdb_changes_since_last_save"),
+		RDBBgsaveInProgress:      infoBool(f, "rdb_bgsave_in_progress"),
+		RDBLastSaveTime:          infoInt(f, "rdb_last_save_time"),
+		RDBLastBgsaveStatus:      f["rdb_last_bgsave_status"],
+		RDBLastBgsaveTimeSec:     infoInt(f, "rdb_last_bgsave_time_sec"),
+		RDBCurrentBgsaveTimeSec:  infoInt(f, "rdb_current_bgsave_time_sec"),
+		AOFEnabled:               infoBool(f, "aof_enabled"),
+		AOFRewriteInProgress:     infoBool(f, "aof_rewrite_in_progress"),
+		AOFRewriteScheduled:      infoBool(f, "aof_rewrite_scheduled"),
+		AOFLastRewriteTimeSec:    infoInt(f, "aof_last_rewrite_time_sec"),
+		AOFCurrentRewriteTimeSec: infoInt(f, "aof_current_rewrite_time_sec"),
+		AOFLastBgrewriteStatus:   f["aof_last_bgrewrite_status"],
+		AOFLastWriteStatus:       f["aof_last_write_status"],
+	}
+
+	f = sections["stats"]
+	info.Stats = StatsInfo{
+		TotalConnectionsReceived: infoInt(f, "total_connections_received"),
+		TotalCommandsProcessed:   infoInt(f, "total_commands_processed"),
+		InstantaneousOpsPerSec:   infoInt(f, "instantaneous_ops_per_sec"),
+		RejectedConnections:      infoInt(f, "rejected_connections"),
+		SyncFull:                 infoInt(f, "sync_full"),
+		SyncPartialOK:            infoInt(f, "sync_partial_ok"),
+		SyncPartialErr:           infoInt(f, "sync_partial_err"),
+		ExpiredKeys:              infoInt(f, "expired_keys"),
+		EvictedKeys:              infoInt(f, "evicted_keys"),
+		KeyspaceHits:             infoInt(f, "keyspace_hits"),
+		KeyspaceMisses:           infoInt(f, "keyspace_misses"),
+		LatestForkUsec:           infoInt(f, "latest_fork_usec"),
+	}
+
+	f = sections["replication"]
+	info.Replication = ReplicationInfo{
+		Role:                   f["role"],
+		ConnectedReplicas:      infoInt(f, "connected_slaves"),
+		MasterHost:             f["master_host"],
+		MasterPort:             infoInt(f, "master_port"),
+		MasterLinkStatus:       f["master_link_status"],
+		MasterLastIOSecondsAgo: infoInt(f, "master_last_io_seconds_ago"),
+		MasterSyncInProgress:   infoBool(f, "master_sync_in_progress"),
+		SlaveReplOffset:        infoInt(f, "slave_repl_offset"),
+		MasterReplOffset:       infoInt(f, "master_repl_offset"),
+	}
+	for i := int64(0); i < info.Replication.ConnectedReplicas; i++ {
+		value, exists := f["slave"+strconv.FormatInt(i, 10)]
+		if !exists {
+			continue
+		}
+		rf := parseInfoFields(value)
+		info.Replication.Replicas = append(info.Replication.Replicas, ReplicaInfo{
+			Addr:   rf["ip"] + ":" + rf["port"],
+			State:  rf["state"],
+			Offset: infoInt(rf, "offset"),
+			Lag:    infoInt(rf, "lag"),
+		})
+	}
+
+	f = sections["clients"]
+	info.Clients = ClientsInfo{
+		ConnectedClients: infoInt(f, "connected_clients"),
+		BlockedClients:   infoInt(f, "blocked_clients"),
+	}
+
+	for db, value := range sections["keyspace"] {
+		kf := parseInfoFields(value)
+		info.Keyspace[db] = KeyspaceInfo{Keys: infoInt(kf, "keys"), Expires: infoInt(kf, "expires"), AvgTTL: infoInt(kf, "avg_ttl")}
+	}
+	for name, value := range sections["commandstats"] {
+		cf := parseInfoFields(value)
+		info.Commandstats[strings.TrimPrefix(name, "cmdstat_")] = CommandStat{
+			Calls:       infoInt(cf, "calls"),
+			Usec:        infoInt(cf, "usec"),
+			UsecPerCall: infoFloat(cf, "usec_per_call"),
+		}
+	}
+	return info
+}
+
+// computeRates derives per second rates from the counters of two snapshots.
+// A counter which went backwards means the node restarted, so no rates are
+// returned.
+func computeRates(prev, cur RedisInfo) (rates InfoRates, ok bool) {
+	elapsed := cur.Timestamp.Sub(prev.Timestamp).Seconds()
+	if elapsed <= 0 || cur.Stats.TotalCommandsProcessed < prev.Stats.TotalCommandsProcessed {
+		return rates, false
+	}
+	rate := func(p, c int64) float64 {
+		if c < p {
+			return 0
+		}
+		return float64(c-p) / elapsed
+	}
+	rates.CommandsPerSec = rate(prev.Stats.TotalCommandsProcessed, cur.Stats.TotalCommandsProcessed)
+	rates.KeyspaceHitsPerSec = rate(prev.Stats.KeyspaceHits, cur.Stats.KeyspaceHits)
+	rates.KeyspaceMissesPerSec = rate(prev.Stats.KeyspaceMisses, cur.Stats.KeyspaceMisses)
+	rates.EvictedKeysPerSec = rate(prev.Stats.EvictedKeys, cur.Stats.EvictedKeys)
+	rates.ExpiredKeysPerSec = rate(prev.Stats.ExpiredKeys, cur.Stats.ExpiredKeys)
+	rates.RejectedConnectionsPerSec = rate(prev.Stats.RejectedConnections, cur.Stats.RejectedConnections)
+	rates.ConnectionsPerSec = rate(prev.Stats.TotalConnectionsReceived, cur.Stats.TotalConnectionsReceived)
+	lookups := rates.KeyspaceHitsPerSec + rates.KeyspaceMissesPerSec
+	if lookups > 0 {
+		rates.HitRatio = rates.KeyspaceHitsPerSec / lookups
+	}
+	return rates, true
+}
+
+// infoMetrics flattens the INFO snapshot and rates into the named metrics
+// candui exports and stores.
+func infoMetrics(info RedisInfo, rates *InfoRates) map[string]float64 {
+	metrics := map[string]float64{
+		"used_memory_bytes":           float64(info.Memory.UsedMemory),
+		"used_memory_rss_bytes":       float64(info.Memory.UsedMemoryRSS),
+		"maxmemory_bytes":             float64(info.Memory.MaxMemory),
+		"mem_fragmentation_ratio":     info.Memory.FragmentationRatio,
+		"connected_clients":           float64(info.Clients.ConnectedClients),
+		"blocked_clients":             float64(info.Clients.BlockedClients),
+		"instantaneous_ops_per_sec":   float64(info.Stats.InstantaneousOpsPerSec),
+		"rdb_changes_since_last_save": float64(info.Persistence.RDBChangesSinceLastSave),
+		"latest_fork_usec":            float64(info.Stats.LatestForkUsec),
+		"rdb_bgsave_in_progress":      boolMetric(info.Persistence.RDBBgsaveInProgress),
+		"aof_enabled":                 boolMetric(info.Persistence.AOFEnabled),
+		"aof_rewrite_in_progress":     boolMetric(info.Persistence.AOFRewriteInProgress),
+		"master_sync_in_progress":     boolMetric(info.Replication.MasterSyncInProgress),
+	}
+	var keys int64
+	for _, db := range info.Keyspace {
+		keys += db.Keys
+	}
+	metrics["keys"] = float64(keys)
+	if rates != nil {
+		metrics["commands_per_sec"] = rates.CommandsPerSec
+		metrics["keyspace_hits_per_sec"] = rates.KeyspaceHitsPerSec
+		metrics["keyspace_misses_per_sec"] = rates.KeyspaceMissesPerSec
+		metrics["evicted_keys_per_sec"] = rates.EvictedKeysPerSec
+		metrics["expired_keys_per_sec"] = rates.ExpiredKeysPerSec
+		metrics["rejected_connections_per_sec"] = rates.RejectedConnectionsPerSec
+		metrics["connections_per_sec"] = rates.ConnectionsPerSec
+		metrics["keyspace_hit_ratio"] = rates.HitRatio
+	}
+	return metrics
+}
+
+// boolMetric exports a flag as 1 or 0
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// getInfo fetches and parses every INFO section of the node
+func getInfo(conn *client.Redis) (RedisInfo, error) {
+	raw, err := getInfoSection(conn, "all")
+	if err != nil {
+		return RedisInfo{}, err
+	}
+	return ParseInfo(raw), nil
+}
+
+// collectInfo polls INFO on the node, computes rates against the previous
+// snapshot and stores the resulting metrics.
+func (n *Node) collectInfo() error {
+	conn, err := n.conn()
+	if err != nil {
+		return err
+	}
+	info, err := getInfo(conn)
+	if err != nil {
+		return err
+	}
+	nodesLock.Lock()
+	prev := n.Info
+	var rates *InfoRates
+	if prev != nil {
+		r, ok := computeRates(*prev, info)
+		if ok {
+			rates = &r
+		}
+	}
+	n.Info = &info
+	n.Rates = rates
+	nodesLock.Unlock()
+	if prev != nil {
+		n.checkReplicationChanges(*prev, info)
+		n.trackPersistence(*prev, info)
+	}
+	if store != nil {
+		ts := info.Timestamp.Unix()
+		for name, value := range infoMetrics(info, rates) {
+			err = store.StoreMetric(n.Name, name, ts, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
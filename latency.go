@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// LatencyEvent is an entry from LATENCY LATEST describing the most recent
+// spike recorded for a given event class. Latencies are in milliseconds.
+type LatencyEvent struct {
+	Name      string
+	Timestamp int64
+	Latest    int64
+	Max       int64
+}
+
+// LatencySample is a single entry from LATENCY HISTORY for an event class.
+type LatencySample struct {
+	Timestamp int64
+	Latency   int64
+}
+
+// Latency harvest modes
+const (
+	// HarvestWatermark only persists samples newer than the last one stored
+	HarvestWatermark = "watermark"
+	// HarvestReset additionally issues LATENCY RESET once samples are stored
+	HarvestReset = "reset"
+)
+
+// latencyHistoryLen is the number of samples Redis keeps per event, and the
+// number candui keeps in memory per event when resetting
+const latencyHistoryLen = 160
+
+// getLatencyLatest calls LATENCY LATEST on the connection and returns every
+// event class Redis currently has data for.
+func getLatencyLatest(conn *client.Redis) (events []LatencyEvent, err error) {
+	rp, err := conn.ExecuteCommand("LATENCY", "LATEST")
+	if err != nil {
+		return events, err
+	}
+	entries, err := rp.MultiValue()
+	if err != nil {
+		return events, err
+	}
+	for _, entry := range entries {
+		if len(entry.Multi) < 4 {
+			return events, fmt.Errorf("Malformed LATENCY LATEST entry: %+v", entry)
+		}
+		name, err := entry.Multi[0].StringValue()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, LatencyEvent{
+			Name:      name,
+			Timestamp: entry.Multi[1].Integer,
+			Latest:    entry.Multi[2].Integer,
+			Max:       entry.Multi[3].Integer,
+		})
+	}
+	return events, nil
+}
+
+// getLatencyHistory calls LATENCY HISTORY for the given event class and
+// returns the samples Redis has buffered for it, oldest first.
+func getLatencyHistory(conn *client.Redis, event string) (samples []LatencySample, err error) {
+	rp, err := conn.ExecuteCommand("LATENCY", "HISTORY", event)
+	if err != nil {
+		return samples, err
+	}
+	return parseLatencyHistory(event, rp)
+}
+
+// getLatencyHistoryAndReset returns the history of the event and resets it
+// in one transaction, so no spike can land between the two and be lost.
+func getLatencyHistoryAndReset(conn *client.Redis, event string) (samples []LatencySample, err error) {
+	tx, err := conn.Transaction()
+	if err != nil {
+		return samples, err
+	}
+	defer tx.Close()
+	err = tx.Command("LATENCY", "HISTORY", event)
+	if err == nil {
+		err = tx.Command("LATENCY", "RESET", event)
+	}
+	if err != nil {
+		tx.Discard()
+		return samples, err
+	}
+	replies, err := tx.Exec()
+	if err != nil {
+		return samples, err
+	}
+	if len(replies) != 2 {
+		return samples, fmt.Errorf("Malformed LATENCY HISTORY/RESET transaction reply for %s", event)
+	}
+	return parseLatencyHistory(event, replies[0])
+}
+
+func parseLatencyHistory(event string, rp *client.Reply) (samples []LatencySample, err error) {
+	entries, err := rp.MultiValue()
+	if err != nil {
+		return samples, err
+	}
+	for _, entry := range entries {
+		if len(entry.Multi) < 2 {
+			return samples, fmt.Errorf("Malformed LATENCY HISTORY entry for %s: %+v", event, entry)
+		}
+		samples = append(samples, LatencySample{Timestamp: entry.Multi[0].Integer, Latency: entry.Multi[1].Integer})
+	}
+	return samples, nil
+}
+
+// collectLatency pulls LATENCY LATEST from the node and then the history for
+// every event class it reports, storing both on the node. It reports whether
+// a spike episode started: this poll found new spikes and the one before
+// didn't. The first poll of a node only takes a baseline, so spikes Redis
+// recorded before candui started don't count.
+func (n *Node) collectLatency() (started bool, err error) {
+	conn, err := n.conn()
+	if err != nil {
+		return false, err
+	}
+	reset := config.LatencyHarvestMode == HarvestReset
+	latest, history, err := fetchLatency(conn, reset)
+	n.recordPoll(err)
+	if err != nil {
+		if reset && len(latest) > 0 {
+			// the events read before the failure were already reset on
+			// the node, so keep them or their samples are lost
+			nodesLock.Lock()
+			n.Events, n.History = mergeLatency(n.Events, n.History, latest, history)
+			nodesLock.Unlock()
+		}
+		return false, err
+	}
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	fresh := n.latencySeen && newSpikes(n.Events, latest)
+	started = fresh && !n.spiking
+	n.spiking = fresh
+	n.latencySeen = true
+	if reset {
+		// Redis only holds what arrived since the last reset, so merge it
+		// into what we already have
+		latest, history = mergeLatency(n.Events, n.History, latest, history)
+	}
+	n.Events = latest
+	n.History = history
+	return started, nil
+}
+
+// spikesSince returns the number of samples of the event held for the node
+// at or after cutoff, a unix time, and the longest of them. The caller must
+// hold nodesLock.
+func (n *Node) spikesSince(event string, cutoff int64) (spikes int, max int64) {
+	for _, sample := range n.History[event] {
+		if sample.Timestamp < cutoff {
+			continue
+		}
+		spikes++
+		if sample.Latency > max {
+			max = sample.Latency
+		}
+	}
+	return spikes, max
+}
+
+// newSpikes reports whether LATENCY LATEST has an event which is new or whose
+// latest spike is more recent than before. LATENCY LATEST keeps an event
+// until it is reset, so its presence alone says nothing.
+func newSpikes(old, latest map[string]LatencyEvent) bool {
+	for name, event := range latest {
+		prev, exists := old[name]
+		if !exists || event.Timestamp > prev.Timestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLatency adds newly fetched latency data to previously held data,
+// keeping the most recent latencyHistoryLen samples per event.
+func mergeLatency(oldLatest map[string]LatencyEvent, oldHistory map[string][]LatencySample, latest map[string]LatencyEvent, history map[string][]LatencySample) (map[string]LatencyEvent, map[string][]LatencySample) {
+	for name, event := range oldLatest {
+		current, exists := latest[name]
+		if !exists {
+			latest[name] = event
+			continue
+		}
+		if event.Max > current.Max {
+			current.Max = event.Max
+			latest[name] = current
+		}
+	}
+	for name, samples := range oldHistory {
+		var last int64
+		if len(samples) > 0 {
+			last = samples[len(samples)-1].Timestamp
+		}
+		merged := samples
+		for _, sample := range history[name] {
+			if sample.Timestamp > last {
+				merged = append(merged, sample)
+			}
+		}
+		if len(merged) > latencyHistoryLen {
+			merged = merged[len(merged)-latencyHistoryLen:]
+		}
+		history[name] = merged
+	}
+	return latest, history
+}
+
+// fetchLatency returns LATENCY LATEST and the history of every event in it.
+// With reset set each event is reset as its history is read; the samples are
+// then only held by candui until they are persisted. If reading an event
+// fails the events read so far are returned along with the error.
+func fetchLatency(conn *client.Redis, reset bool) (latest map[string]LatencyEvent, history map[string][]LatencySample, err error) {
+	events, err := getLatencyLatest(conn)
+	if err != nil {
+		return latest, history, err
+	}
+	latest = make(map[string]LatencyEvent)
+	history = make(map[string][]LatencySample)
+	for _, event := range events {
+		var samples []LatencySample
+		if reset {
+			samples, err = getLatencyHistoryAndReset(conn, event.Name)
+		} else {
+			samples, err = getLatencyHistory(conn, event.Name)
+		}
+		if err != nil {
+			return latest, history, err
+		}
+		latest[event.Name] = event
+		history[event.Name] = samples
+	}
+	return latest, history, nil
+}
+
+// persistLatency writes the samples held for the node which are newer than
+// the node's watermark for their event to the data store, advancing the
+// watermark as it goes. In reset mode the samples were already reset on the
+// node when collected, and are kept in memory until stored here.
+func (n *Node) persistLatency(ds DataStore) error {
+	nodesLock.RLock()
+	history := n.History
+	nodesLock.RUnlock()
+	for event, samples := range history {
+		watermark := n.watermark(event)
+		for _, sample := range samples {
+			if sample.Timestamp <= watermark {
+				continue
+			}
+			err := ds.StoreEventEntry(n.Name, event, sample.Timestamp, sample.Latency)
+			if err != nil {
+				return err
+			}
+			n.setWatermark(event, sample.Timestamp)
+		}
+	}
+	return nil
+}
+
+// watermark returns the timestamp of the newest sample of the event stored
+func (n *Node) watermark(event string) int64 {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	return n.Watermarks[event]
+}
+
+func (n *Node) setWatermark(event string, timestamp int64) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	if n.Watermarks == nil {
+		n.Watermarks = make(map[string]int64)
+	}
+	if timestamp > n.Watermarks[event] {
+		n.Watermarks[event] = timestamp
+	}
+}
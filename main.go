@@ -3,21 +3,53 @@ package main
 import (
 	"fmt"
 	"log/syslog"
+	"math/rand"
+	"os"
 	"runtime"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/therealbill/libredis/client"
 )
 
-// LaunchConfig is the configuration used by the main app
+// LaunchConfig is the configuration used by the main app. It is read from
+// the YAML file named by ConfigFile, then overridden by CANDUI_* environment
+// variables and finally by command line flags.
 type LaunchConfig struct {
-	RedisConnectionString string
-	RedisAuthToken        string
-	SentinelConfigFile    string
-	LatencyThreshold      int
+	ConfigFile            string                   `yaml:"-"`
+	RedisConnectionString string                   `yaml:"redis_connection_string"`
+	RedisAuthToken        string                   `yaml:"redis_auth_token"`
+	SentinelConfigFile    string                   `yaml:"sentinel_config_file"`
+	SentinelConfigFiles   []string                 `yaml:"sentinel_config_files"`
+	LatencyThreshold      int                      `yaml:"latency_threshold"`
+	StoreAddress          string                   `yaml:"store_address"`
+	StoreAuthToken        string                   `yaml:"store_auth_token"`
+	StoreSentinels        []string                 `yaml:"store_sentinels"`
+	StorePodName          string                   `yaml:"store_pod_name"`
+	HTTPListen            string                   `yaml:"http_listen"`
+	MonitorSentinels      bool                     `yaml:"monitor_sentinels"`
+	SentinelAddresses     []string                 `yaml:"sentinel_addresses"`
+	PollConcurrency       int                      `yaml:"poll_concurrency"`
+	NodeTimeout           time.Duration            `yaml:"node_timeout"`
+	PollInterval          time.Duration            `yaml:"poll_interval"`
+	PodIntervals          map[string]time.Duration `yaml:"pod_intervals"`
+	AlertConfigFile       string                   `yaml:"alert_config_file"`
+	// Alerts is the alerting config given inline in the config file
+	Alerts              *AlertConfig   `yaml:"alerts" ignored:"true"`
+	PodThresholds       map[string]int `yaml:"pod_thresholds"`
+	NodeThresholds      map[string]int `yaml:"node_thresholds"`
+	ThresholdReportOnly bool           `yaml:"threshold_report_only"`
+	// ObserveOnly stops candui from ever changing the config of a node
+	ObserveOnly         bool   `yaml:"observe_only"`
+	LatencyHarvestMode  string `yaml:"latency_harvest_mode"`
+	SlowlogCount        int    `yaml:"slowlog_count"`
+	SlowlogMaxArgs      int    `yaml:"slowlog_max_args"`
+	SlowlogMaxArgLength int    `yaml:"slowlog_max_arg_length"`
+	SlowlogRedactArgs   bool   `yaml:"slowlog_redact_args"`
+	// ReplicationLagBytes is how far behind its master a replica may fall
+	// before it is flagged as lagging
+	ReplicationLagBytes int64 `yaml:"replication_lag_bytes"`
 }
 
 var config LaunchConfig
@@ -30,84 +62,150 @@ type Node struct {
 	Pod        SentinelPodConfig
 	Role       string
 	Connection *client.Redis
+	Events     map[string]LatencyEvent
+	History    map[string][]LatencySample
+	LastPoll   time.Time
+	LastError  string
+	// SentinelStatus is the sdown/odown state last reported by sentinel
+	SentinelStatus string
+	Annotations    []Annotation
+	// State is one of the Node* lifecycle states. A node left out of the
+	// topology stays NodeRemoved, and is no longer polled, until RemovedAt
+	// is a poll interval ago so its removal can be seen
+	State     string
+	RemovedAt time.Time
+	Failures  int
+	NextDial  time.Time
+	NextPoll  time.Time
+	// Slowlog holds the most recent slowlog entries, oldest first, and
+	// SlowlogID the ID of the newest one, -1 before any is seen as slowlog
+	// IDs start at 0
+	Slowlog   []SlowlogEntry
+	SlowlogID int64
+	// Info is the latest INFO snapshot and Rates the rates computed from it
+	// and the one before
+	Info         *RedisInfo
+	Rates        *InfoRates
+	LastFullSync time.Time
+	// Persistence is the node's timeline of bgsaves and AOF rewrites
+	Persistence []PersistenceEvent
+	// LastReport is the diagnostics captured when spikes last started
+	LastReport *DiagnosticReport
+	// latencySeen is set once the node's latency has been collected, and
+	// spiking while its last collection found new spikes
+	latencySeen bool
+	spiking     bool
+	// Watermarks is the timestamp of the newest sample stored per event
+	Watermarks map[string]int64
+	// Threshold is the node's latency-monitor-threshold as last seen, 0
+	// means latency monitoring is disabled on the node
+	Threshold        int
+	thresholdChecked bool
+	// polling is set while a poll of the node is in flight
+	polling bool
 }
 
 // containers
 var Nodes map[string]*Node
 
+// nodesLock guards Nodes and the state held on each node
+var nodesLock sync.RWMutex
+
 func init() {
 	// initialize logging
 	logger, _ = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "candui")
-	err := envconfig.Process("candui", &config)
-	if err != nil {
-		logger.Warning(err.Error())
-	}
-	sconfig.ManagedPodConfigs = make(map[string]SentinelPodConfig)
-	if config.SentinelConfigFile == "" {
-		config.SentinelConfigFile = "/etc/redis/sentinel.conf"
-	}
-	if config.LatencyThreshold == 0 {
-		config.LatencyThreshold = 50
+	rand.Seed(time.Now().UnixNano())
+}
+
+// setup makes cfg the running configuration and sets up the data store and
+// alerting from it
+func setup(cfg LaunchConfig) {
+	config = cfg
+	store = NewDataStore(config)
+	if config.Alerts != nil {
+		configureAlerting(*config.Alerts)
 	}
 }
 
-func loadMastersFromFile() {
-	LoadSentinelConfigFile()
-	logger.Info(fmt.Sprintf("Loading %d pods ", len(sconfig.ManagedPodConfigs)))
-	for _, pod := range sconfig.ManagedPodConfigs {
-		nodename := fmt.Sprintf("%s:%d", pod.IP, pod.Port)
-		node, exists := Nodes[nodename]
-		if !exists {
-			conn, err := client.DialWithConfig(&client.DialConfig{Address: nodename, Password: pod.AuthToken})
-			if err != nil {
-				logger.Warning("Error connecting to node " + nodename)
-				continue
-			}
-			node = &Node{Name: nodename, Pod: pod, Connection: conn}
-			if Nodes == nil {
-				Nodes = make(map[string]*Node)
-			}
-			Nodes[nodename] = node
-			err = node.Connection.ConfigSetInt("latency-monitor-threshold", config.LatencyThreshold)
-			if err != nil {
-				logger.Warning("Unable to enable latency on " + nodename)
-			}
-		}
+// refreshTopology reloads the topology from the configured source
+func refreshTopology() {
+	if len(config.SentinelAddresses) > 0 || !watchingSentinelConfig {
+		loadTopology(true)
 	}
+	ensureSentinelWatchers()
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+
+	logger.Warning(fmt.Sprintf("[Memory Usage] InUse: %s System: %s", humanize.Bytes(memStats.Alloc), humanize.Bytes(memStats.Sys)))
 }
 
 func checkForLatencyOnNodes() {
-	loadMastersFromFile()
+	now := time.Now()
+	if now.Sub(lastTopologyRefresh) >= config.PollInterval {
+		refreshTopology()
+		lastTopologyRefresh = now
+	}
+	nodes := dueNodes(now)
+	if len(nodes) == 0 {
+		return
+	}
 	latent_nodecount := 0
 	nonlatent_nodecount := 0
-	logger.Warning(fmt.Sprintf("Checking %d nodes for latency", len(Nodes)))
-	for _, node := range Nodes {
-		results, err := node.Connection.LatencyHistory("command")
-		_ = strings.Contains
-		if err != nil {
-			logger.Warning(node.Name + " - RR- " + err.Error())
+	unmonitored_nodecount := 0
+	// only nodes which answered are evaluated, so a failed poll neither
+	// fires nor resolves an alert
+	var polled []*Node
+	logger.Info(fmt.Sprintf("Checking %d nodes for latency", len(nodes)))
+	for _, res := range pollNodes(nodes) {
+		if res.Err != nil {
+			if res.Role == RoleSentinel {
+				logger.Warning(res.Node.Name + " - sentinel unreachable: " + res.Err.Error())
+			} else {
+				logger.Warning(res.Node.Name + " - RR- " + res.Err.Error())
+			}
+			countPollError(res.Node.Name)
 			continue
 		}
-		history := results.Records
-		if len(history) == 0 {
-			nonlatent_nodecount++
-		} else {
+		if res.Role == RoleSentinel {
+			continue
+		}
+		polled = append(polled, res.Node)
+		if res.Unmonitored {
+			unmonitored_nodecount++
+		} else if res.Latent {
 			latent_nodecount++
+		} else {
+			nonlatent_nodecount++
 		}
 	}
-	logger.Warning(fmt.Sprintf("Found %d nodes with latency spikes", latent_nodecount))
-	logger.Warning(fmt.Sprintf("Found %d nodes with NO latency spikes", nonlatent_nodecount))
-	memStats := &runtime.MemStats{}
-	runtime.ReadMemStats(memStats)
-
-	logger.Warning(fmt.Sprintf("[Memory Usage] InUse: %s System: %s", humanize.Bytes(memStats.Alloc), humanize.Bytes(memStats.Sys)))
-
+	evaluateAlerts(polled)
+	logger.Info(fmt.Sprintf("Found %d nodes with latency spikes", latent_nodecount))
+	logger.Info(fmt.Sprintf("Found %d nodes with NO latency spikes", nonlatent_nodecount))
+	if unmonitored_nodecount > 0 {
+		logger.Warning(fmt.Sprintf("Found %d nodes with latency monitoring disabled", unmonitored_nodecount))
+	}
 }
 
-func main() {
+// runDaemon polls the nodes forever, serving the HTTP API if configured
+func runDaemon() {
+	if config.HTTPListen != "" {
+		go startHTTPServer()
+	}
+	reloadOnHangup()
+	loadTopology(true)
+	lastTopologyRefresh = time.Now()
+	if len(fileSourcePatterns()) > 0 {
+		err := watchSentinelConfig()
+		if err != nil {
+			logger.Warning("Unable to watch sentinel config, reloading it every poll interval: " + err.Error())
+		}
+	}
 	for {
-		go checkForLatencyOnNodes()
-		time.Sleep(time.Second * 60)
+		go runPollCycle()
+		time.Sleep(scheduleTick)
 	}
+}
 
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// nodeCounters are the monotonically increasing counters kept per node
+type nodeCounters struct {
+	PollErrors         int64
+	ConnectionFailures int64
+	ThresholdDrifts    int64
+}
+
+// counters are keyed by node name, and dropped when the node is removed.
+// countersLock is taken after nodesLock when both are held.
+var counters = make(map[string]*nodeCounters)
+var countersLock sync.Mutex
+
+// count updates the counters of the node, unless it has been removed so a
+// poll finishing after the removal doesn't bring them back
+func count(nodename string, update func(*nodeCounters)) {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	if _, exists := Nodes[nodename]; !exists {
+		return
+	}
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	c, exists := counters[nodename]
+	if !exists {
+		c = &nodeCounters{}
+		counters[nodename] = c
+	}
+	update(c)
+}
+
+// countPollError records a failed poll of the node
+func countPollError(nodename string) {
+	count(nodename, func(c *nodeCounters) { c.PollErrors++ })
+}
+
+// countConnectionFailure records a failed attempt to connect to the node
+func countConnectionFailure(nodename string) {
+	count(nodename, func(c *nodeCounters) { c.ConnectionFailures++ })
+}
+
+// countThresholdDrift records a latency-monitor-threshold found changed
+func countThresholdDrift(nodename string) {
+	count(nodename, func(c *nodeCounters) { c.ThresholdDrifts++ })
+}
+
+// dropCounters forgets the counters of a node which was removed
+func dropCounters(nodename string) {
+	countersLock.Lock()
+	delete(counters, nodename)
+	countersLock.Unlock()
+}
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatLabels(labels ...string) string {
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricWriter emits metric families in the Prometheus text exposition format
+type metricWriter struct {
+	w io.Writer
+}
+
+func (m metricWriter) header(name, mtype, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+func (m metricWriter) sample(name string, value interface{}, labels ...string) {
+	fmt.Fprintf(m.w, "%s%s %v\n", name, formatLabels(labels...), value)
+}
+
+// writeMetrics writes the current node state as Prometheus metrics
+func writeMetrics(w io.Writer) {
+	m := metricWriter{w: w}
+	nodesLock.RLock()
+	nodes := make([]*Node, 0, len(Nodes))
+	for _, node := range Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	m.header("candui_node_up", "gauge", "Whether the last poll of the node succeeded.")
+	for _, node := range nodes {
+		up := 0
+		if node.status().Healthy {
+			up = 1
+		}
+		m.sample("candui_node_up", up, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+
+	m.header("candui_node_removed", "gauge", "Whether the node has been removed from the topology and is about to be dropped.")
+	for _, node := range nodes {
+		removed := 0
+		if node.State == NodeRemoved {
+			removed = 1
+		}
+		m.sample("candui_node_removed", removed, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+
+	m.header("candui_latency_monitor_threshold_milliseconds", "gauge", "The node's latency-monitor-threshold as last seen.")
+	for _, node := range nodes {
+		if node.Role == RoleSentinel {
+			continue
+		}
+		m.sample("candui_latency_monitor_threshold_milliseconds", node.Threshold, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+
+	m.header("candui_latency_monitored", "gauge", "Whether latency monitoring is enabled on the node.")
+	for _, node := range nodes {
+		status := node.status()
+		if node.Role == RoleSentinel {
+			continue
+		}
+		monitored := 1
+		if status.Unmonitored {
+			monitored = 0
+		}
+		m.sample("candui_latency_monitored", monitored, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+
+	m.header("candui_latency_latest_milliseconds", "gauge", "Latest latency spike reported by LATENCY LATEST.")
+	for _, node := range nodes {
+		for _, event := range sortedEvents(node.Events) {
+			m.sample("candui_latency_latest_milliseconds", event.Latest, "pod", node.Pod.Name, "node", node.Name, "role", node.Role, "event", event.Name)
+		}
+	}
+	m.header("candui_latency_max_milliseconds", "gauge", "All time maximum latency spike reported by LATENCY LATEST.")
+	for _, node := range nodes {
+		for _, event := range sortedEvents(node.Events) {
+			m.sample("candui_latency_max_milliseconds", event.Max, "pod", node.Pod.Name, "node", node.Name, "role", node.Role, "event", event.Name)
+		}
+	}
+	m.header("candui_latency_last_spike_timestamp_seconds", "gauge", "Unix time of the latest latency spike reported by LATENCY LATEST.")
+	for _, node := range nodes {
+		for _, event := range sortedEvents(node.Events) {
+			m.sample("candui_latency_last_spike_timestamp_seconds", event.Timestamp, "pod", node.Pod.Name, "node", node.Name, "role", node.Role, "event", event.Name)
+		}
+	}
+	writeInfoMetrics(m, nodes)
+	writeReplicationMetrics(m)
+	writeCounterMetrics(m, nodes)
+	nodesLock.RUnlock()
+}
+
+// writeCounterMetrics writes the counters of every node which has any. The
+// caller must hold nodesLock.
+func writeCounterMetrics(m metricWriter, nodes []*Node) {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	counted := make([]*Node, 0, len(counters))
+	for _, node := range nodes {
+		if counters[node.Name] != nil {
+			counted = append(counted, node)
+		}
+	}
+	m.header("candui_poll_errors_total", "counter", "Number of failed polls of the node.")
+	for _, node := range counted {
+		m.sample("candui_poll_errors_total", counters[node.Name].PollErrors, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+	m.header("candui_connection_failures_total", "counter", "Number of failed attempts to connect to the node.")
+	for _, node := range counted {
+		m.sample("candui_connection_failures_total", counters[node.Name].ConnectionFailures, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+	m.header("candui_threshold_drift_total", "counter", "Number of times the node's latency-monitor-threshold was found changed.")
+	for _, node := range counted {
+		m.sample("candui_threshold_drift_total", counters[node.Name].ThresholdDrifts, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+	}
+}
+
+// writeInfoMetrics writes the INFO derived metrics of every node as
+// candui_redis_<metric>. The caller must hold nodesLock.
+func writeInfoMetrics(m metricWriter, nodes []*Node) {
+	values := make(map[string]map[*Node]float64)
+	for _, node := range nodes {
+		if node.Info == nil {
+			continue
+		}
+		for name, value := range infoMetrics(*node.Info, node.Rates) {
+			if values[name] == nil {
+				values[name] = make(map[*Node]float64)
+			}
+			values[name][node] = value
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metric := "candui_redis_" + name
+		m.header(metric, "gauge", "The node's "+name+" from INFO.")
+		for _, node := range nodes {
+			value, exists := values[name][node]
+			if exists {
+				m.sample(metric, value, "pod", node.Pod.Name, "node", node.Name, "role", node.Role)
+			}
+		}
+	}
+}
+
+func sortedEvents(events map[string]LatencyEvent) []LatencyEvent {
+	sorted := make([]LatencyEvent, 0, len(events))
+	for _, event := range events {
+		sorted = append(sorted, event)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// handleMetrics renders the metrics into a buffer, which holds nodesLock, and
+// only then writes them to the client so a slow scrape can't hold up polling.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Nagios plugin states, which are also the exit codes
+const (
+	NagiosOK       = 0
+	NagiosWarning  = 1
+	NagiosCritical = 2
+	NagiosUnknown  = 3
+)
+
+var nagiosStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// NagiosThresholds are the limits a node's events are checked against. A
+// value is in breach when it exceeds the limit; a negative limit is off.
+type NagiosThresholds struct {
+	Window        time.Duration
+	WarnSpikes    int
+	CritSpikes    int
+	WarnLatencyMs int64
+	CritLatencyMs int64
+}
+
+// nagiosEvent is the outcome of checking one event of a node
+type nagiosEvent struct {
+	Node   string
+	Event  string
+	Spikes int
+	MaxMs  int64
+	State  int
+}
+
+// addFlags adds the threshold flags to the flag set
+func (t *NagiosThresholds) addFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&t.Window, "window", t.Window, "only count spikes within this long")
+	fs.IntVar(&t.WarnSpikes, "warning-spikes", t.WarnSpikes, "warn when an event has more spikes than this in the window")
+	fs.IntVar(&t.CritSpikes, "critical-spikes", t.CritSpikes, "critical when an event has more spikes than this in the window")
+	fs.Int64Var(&t.WarnLatencyMs, "warning-latency", t.WarnLatencyMs, "warn when a spike in the window exceeds this many `ms`")
+	fs.Int64Var(&t.CritLatencyMs, "critical-latency", t.CritLatencyMs, "critical when a spike in the window exceeds this many `ms`")
+}
+
+// state returns the state of an event given its spikes and max latency
+func (t NagiosThresholds) state(spikes int, maxMs int64) int {
+	breached := func(value, limit int64) bool {
+		return limit >= 0 && value > limit
+	}
+	if breached(int64(spikes), int64(t.CritSpikes)) || breached(maxMs, t.CritLatencyMs) {
+		return NagiosCritical
+	}
+	if breached(int64(spikes), int64(t.WarnSpikes)) || breached(maxMs, t.WarnLatencyMs) {
+		return NagiosWarning
+	}
+	return NagiosOK
+}
+
+// checkEvents returns the spike count and max latency within the window of
+// every event of the node. The caller must hold nodesLock.
+func (t NagiosThresholds) checkEvents(n *Node, now time.Time) []nagiosEvent {
+	cutoff := now.Add(-t.Window).Unix()
+	var events []nagiosEvent
+	for name := range n.Events {
+		ev := nagiosEvent{Node: n.Name, Event: name}
+		ev.Spikes, ev.MaxMs = n.spikesSince(name, cutoff)
+		ev.State = t.state(ev.Spikes, ev.MaxMs)
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Event < events[j].Event })
+	return events
+}
+
+func perfLimit(limit int64) string {
+	if limit < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", limit)
+}
+
+// perfLabel quotes a perfdata label, which can't contain ' or =
+func perfLabel(label string) string {
+	return "'" + strings.NewReplacer("'", "", "=", "").Replace(label) + "'"
+}
+
+// writeNagiosReport writes the poll results as plugin output and returns the
+// overall state. A node which couldn't be polled, or has latency monitoring
+// disabled, is UNKNOWN; the overall state is the worst of CRITICAL, WARNING
+// and UNKNOWN found.
+func writeNagiosReport(out io.Writer, results []pollResult, t NagiosThresholds) int {
+	now := time.Now()
+	var events []nagiosEvent
+	var problems []string
+	unknown, latent := 0, 0
+	nodesLock.RLock()
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			unknown++
+			problems = append(problems, fmt.Sprintf("UNKNOWN: %s %s", res.Node.Name, res.Err.Error()))
+			continue
+		case res.Unmonitored:
+			unknown++
+			problems = append(problems, fmt.Sprintf("UNKNOWN: %s has latency monitoring disabled", res.Node.Name))
+			continue
+		case res.Role == RoleSentinel:
+			continue
+		}
+		nodeEvents := t.checkEvents(res.Node, now)
+		for _, ev := range nodeEvents {
+			if ev.Spikes > 0 {
+				latent++
+				break
+			}
+		}
+		events = append(events, nodeEvents...)
+	}
+	nodesLock.RUnlock()
+
+	worst := NagiosOK
+	var maxEvent *nagiosEvent
+	for i, ev := range events {
+		if ev.State > worst {
+			worst = ev.State
+		}
+		if ev.State != NagiosOK {
+			problems = append(problems, fmt.Sprintf("%s: %s %s had %d spikes, max %dms", nagiosStateNames[ev.State], ev.Node, ev.Event, ev.Spikes, ev.MaxMs))
+		}
+		if maxEvent == nil || ev.MaxMs > maxEvent.MaxMs {
+			maxEvent = &events[i]
+		}
+	}
+	if worst == NagiosOK && unknown > 0 {
+		worst = NagiosUnknown
+	}
+
+	summary := fmt.Sprintf("%d of %d nodes had latency spikes in the last %s", latent, len(results), t.Window)
+	if maxEvent != nil && maxEvent.MaxMs > 0 {
+		summary += fmt.Sprintf(", max %dms (%s %s)", maxEvent.MaxMs, maxEvent.Node, maxEvent.Event)
+	}
+	if unknown > 0 {
+		summary += fmt.Sprintf(", %d nodes unknown", unknown)
+	}
+	var perfdata []string
+	for _, ev := range events {
+		label := ev.Node + " " + ev.Event
+		perfdata = append(perfdata,
+			fmt.Sprintf("%s=%d;%s;%s;0", perfLabel(label+" spikes"), ev.Spikes, perfLimit(int64(t.WarnSpikes)), perfLimit(int64(t.CritSpikes))),
+			fmt.Sprintf("%s=%dms;%s;%s;0", perfLabel(label+" max"), ev.MaxMs, perfLimit(t.WarnLatencyMs), perfLimit(t.CritLatencyMs)))
+	}
+	fmt.Fprintf(out, "CANDUI %s - %s", nagiosStateNames[worst], summary)
+	if len(perfdata) > 0 {
+		fmt.Fprint(out, " | "+strings.Join(perfdata, " "))
+	}
+	fmt.Fprintln(out)
+	sort.Strings(problems)
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	return worst
+}
+
+// nagiosCommand polls every node once and reports the result as a Nagios or
+// Icinga plugin
+func nagiosCommand(args []string) int {
+	t := NagiosThresholds{Window: 5 * time.Minute, WarnSpikes: 0, CritSpikes: 10, WarnLatencyMs: 250, CritLatencyMs: 1000}
+	if _, ok := commandSetupWithFlags("nagios", args, t.addFlags); !ok {
+		fmt.Println("CANDUI UNKNOWN - invalid configuration")
+		return NagiosUnknown
+	}
+	results := pollOnce()
+	if len(results) == 0 {
+		fmt.Println("CANDUI UNKNOWN - no nodes found in the topology")
+		return NagiosUnknown
+	}
+	return writeNagiosReport(os.Stdout, results, t)
+}
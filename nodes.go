@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// Node states
+const (
+	NodeConnecting = "connecting"
+	NodeHealthy    = "healthy"
+	NodeErroring   = "erroring"
+	NodeRemoved    = "removed"
+)
+
+// Reconnection backoff bounds
+const (
+	minRedialBackoff = 5 * time.Second
+	maxRedialBackoff = 5 * time.Minute
+)
+
+// redialBackoff returns how long to wait before redialing a node which has
+// failed the given number of consecutive times.
+func redialBackoff(failures int) time.Duration {
+	backoff := minRedialBackoff
+	for i := 1; i < failures && backoff < maxRedialBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRedialBackoff {
+		backoff = maxRedialBackoff
+	}
+	return backoff
+}
+
+// loadNodes adds any node in the specs which is not yet known and updates the
+// pod and role of the ones which are. It does not remove nodes, see
+// applyTopology for that.
+func loadNodes(specs map[string]NodeSpec) {
+	updateNodes(specs, false)
+}
+
+// applyTopology makes the node set match the specs: unknown nodes are added,
+// known ones updated and nodes missing from the specs removed, all under a
+// single hold of nodesLock. The added nodes are dialed by their first poll.
+// A removed node is marked NodeRemoved and kept, unpolled, for a poll
+// interval so the API and /metrics show it, then dropped along with its
+// connection once no poll of it is in flight.
+func applyTopology(specs map[string]NodeSpec) TopologyDiff {
+	return updateNodes(specs, true)
+}
+
+func updateNodes(specs map[string]NodeSpec, prune bool) (diff TopologyDiff) {
+	nodesLock.Lock()
+	if Nodes == nil {
+		Nodes = make(map[string]*Node)
+	}
+	for nodename, spec := range specs {
+		node, exists := Nodes[nodename]
+		if !exists {
+			node = &Node{Name: nodename, Pod: spec.Pod, Role: spec.Role, State: NodeConnecting, SlowlogID: -1}
+			Nodes[nodename] = node
+			diff.AddedNodes = append(diff.AddedNodes, nodename)
+			continue
+		}
+		if node.State == NodeRemoved {
+			// back in the topology before it was dropped
+			logger.Info(fmt.Sprintf("Node %s of pod %s is back in the topology", nodename, spec.Pod.Name))
+			node.State = NodeConnecting
+			node.RemovedAt = time.Time{}
+			diff.AddedNodes = append(diff.AddedNodes, nodename)
+		}
+		if node.Pod.AuthToken != spec.Pod.AuthToken {
+			// force a redial with the new credentials
+			node.disconnect()
+			node.NextDial = time.Time{}
+		}
+		if node.Role != spec.Role || node.Pod.Name != spec.Pod.Name {
+			diff.ChangedNodes = append(diff.ChangedNodes, nodename)
+		}
+		node.Pod = spec.Pod
+		node.Role = spec.Role
+	}
+	if prune {
+		now := time.Now()
+		for nodename, node := range Nodes {
+			if _, exists := specs[nodename]; exists {
+				continue
+			}
+			if node.State != NodeRemoved {
+				logger.Info(fmt.Sprintf("Removing node %s of pod %s, no longer in the topology", nodename, node.Pod.Name))
+				node.State = NodeRemoved
+				node.RemovedAt = now
+				diff.RemovedNodes = append(diff.RemovedNodes, nodename)
+			}
+		}
+		dropRemovedNodes(now)
+	}
+	nodesLock.Unlock()
+	diff.sort()
+	return diff
+}
+
+// dropRemovedNodes drops the nodes removed at least a poll interval ago,
+// closing their connection, once no poll of them is in flight. The caller
+// must hold nodesLock.
+func dropRemovedNodes(now time.Time) {
+	for nodename, node := range Nodes {
+		if node.State != NodeRemoved || node.polling || now.Sub(node.RemovedAt) < config.PollInterval {
+			continue
+		}
+		node.disconnect()
+		delete(Nodes, nodename)
+		dropCounters(nodename)
+	}
+}
+
+// dial connects the node if it has no connection and its redial backoff has
+// expired. It is called from the node's poll so a slow or dead node only
+// holds up its own poll worker, within the poll deadline.
+func (n *Node) dial() error {
+	nodesLock.RLock()
+	connected := n.Connection != nil
+	backoff := time.Now().Before(n.NextDial)
+	nodesLock.RUnlock()
+	if connected || backoff {
+		return nil
+	}
+	return n.connect()
+}
+
+// connect dials the node. On failure the next attempt is scheduled with an
+// exponential backoff.
+func (n *Node) connect() error {
+	nodesLock.RLock()
+	password := n.Pod.AuthToken
+	isSentinel := n.Role == RoleSentinel
+	nodesLock.RUnlock()
+	if isSentinel {
+		password = ""
+	}
+	conn, err := client.DialWithConfig(&client.DialConfig{Address: n.Name, Password: password, Timeout: config.NodeTimeout})
+	if err != nil {
+		countConnectionFailure(n.Name)
+		nodesLock.Lock()
+		n.Failures++
+		if n.State != NodeRemoved {
+			n.State = NodeErroring
+		}
+		n.LastError = err.Error()
+		n.NextDial = time.Now().Add(redialBackoff(n.Failures))
+		nodesLock.Unlock()
+		logger.Warning(fmt.Sprintf("Error connecting to node %s, retrying in %s", n.Name, redialBackoff(n.Failures)))
+		return fmt.Errorf("unable to connect: %s", err.Error())
+	}
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	if n.State == NodeRemoved {
+		conn.ClosePool()
+		return fmt.Errorf("%s has been removed", n.Name)
+	}
+	n.Connection = conn
+	n.State = NodeConnecting
+	return nil
+}
+
+// disconnect closes the node's connection. The caller must hold nodesLock.
+func (n *Node) disconnect() {
+	if n.Connection != nil {
+		n.Connection.ClosePool()
+		n.Connection = nil
+	}
+}
+
+// recordPoll updates the node state with the outcome of a poll. If the poll
+// failed and the node no longer answers PING the connection is dropped so it
+// is redialed with backoff.
+func (n *Node) recordPoll(err error) {
+	nodesLock.RLock()
+	conn := n.Connection
+	nodesLock.RUnlock()
+	broken := err != nil && (conn == nil || conn.Ping() != nil)
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	n.LastPoll = time.Now()
+	if n.State == NodeRemoved {
+		// the poll was in flight when the node was removed
+		return
+	}
+	if err == nil {
+		n.LastError = ""
+		n.State = NodeHealthy
+		n.Failures = 0
+		return
+	}
+	n.LastError = err.Error()
+	n.State = NodeErroring
+	n.Failures++
+	if broken {
+		n.disconnect()
+		n.NextDial = time.Now().Add(redialBackoff(n.Failures))
+	}
+}
+
+// conn returns the node's current connection or an error if it has none
+func (n *Node) conn() (*client.Redis, error) {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	if n.Connection == nil {
+		return nil, fmt.Errorf("%s is not connected", n.Name)
+	}
+	return n.Connection, nil
+}
+
+// checkSentinel pings a sentinel node. Sentinels do not support the LATENCY
+// commands so only their reachability is tracked.
+func (n *Node) checkSentinel() error {
+	conn, err := n.conn()
+	if err == nil {
+		err = conn.Ping()
+	}
+	n.recordPoll(err)
+	return err
+}
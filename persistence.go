@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Persistence event kinds and phases
+const (
+	PersistBgsave     = "bgsave"
+	PersistAOFRewrite = "aof-rewrite"
+	PhaseStart        = "start"
+	PhaseEnd          = "end"
+)
+
+// forkCorrelationWindow is how far from the start of a bgsave or rewrite a
+// fork latency spike may be to be attributed to it
+const forkCorrelationWindow = 5
+
+// maxPersistenceEvents is the number of persistence events kept per node
+const maxPersistenceEvents = 100
+
+// PersistenceEvent marks the start or end of a bgsave or AOF rewrite, with
+// the fork latency spikes that line up with its start.
+type PersistenceEvent struct {
+	Timestamp int64
+	Kind      string
+	Phase     string
+	// Start is when the bgsave or rewrite began, which fork spikes are
+	// correlated with
+	Start int64
+	// Status and DurationSec are only set on end events
+	Status      string
+	DurationSec int64
+	ForkUsec    int64
+	ForkSpikes  []LatencySample
+}
+
+// persistenceChanges compares two INFO snapshots and returns the bgsave and
+// AOF rewrite starts and ends between them. The start of a run which ended
+// is taken from the previous snapshot, which saw it in progress, rather than
+// worked back from the poll time. A bgsave which started and finished
+// between the snapshots is detected by rdb_last_save_time moving.
+func persistenceChanges(prev, cur RedisInfo) (events []PersistenceEvent) {
+	now, then := cur.Timestamp.Unix(), prev.Timestamp.Unix()
+	p, c := prev.Persistence, cur.Persistence
+	switch {
+	case !p.RDBBgsaveInProgress && c.RDBBgsaveInProgress:
+		start := now - c.RDBCurrentBgsaveTimeSec
+		events = append(events, PersistenceEvent{Timestamp: start, Start: start, Kind: PersistBgsave, Phase: PhaseStart, ForkUsec: cur.Stats.LatestForkUsec})
+	case p.RDBBgsaveInProgress && !c.RDBBgsaveInProgress:
+		start := then - p.RDBCurrentBgsaveTimeSec
+		// rdb_last_save_time only moves when the bgsave succeeded
+		end := start + c.RDBLastBgsaveTimeSec
+		if c.RDBLastSaveTime > p.RDBLastSaveTime {
+			end = c.RDBLastSaveTime
+		}
+		events = append(events, PersistenceEvent{Timestamp: end, Start: start, Kind: PersistBgsave, Phase: PhaseEnd, Status: c.RDBLastBgsaveStatus, DurationSec: c.RDBLastBgsaveTimeSec, ForkUsec: cur.Stats.LatestForkUsec})
+	case !p.RDBBgsaveInProgress && !c.RDBBgsaveInProgress && c.RDBLastSaveTime > p.RDBLastSaveTime && p.RDBLastSaveTime > 0:
+		start := c.RDBLastSaveTime - c.RDBLastBgsaveTimeSec
+		events = append(events,
+			PersistenceEvent{Timestamp: start, Start: start, Kind: PersistBgsave, Phase: PhaseStart, ForkUsec: cur.Stats.LatestForkUsec},
+			PersistenceEvent{Timestamp: c.RDBLastSaveTime, Start: start, Kind: PersistBgsave, Phase: PhaseEnd, Status: c.RDBLastBgsaveStatus, DurationSec: c.RDBLastBgsaveTimeSec, ForkUsec: cur.Stats.LatestForkUsec})
+	}
+	switch {
+	case !p.AOFRewriteInProgress && c.AOFRewriteInProgress:
+		start := now - c.AOFCurrentRewriteTimeSec
+		events = append(events, PersistenceEvent{Timestamp: start, Start: start, Kind: PersistAOFRewrite, Phase: PhaseStart, ForkUsec: cur.Stats.LatestForkUsec})
+	case p.AOFRewriteInProgress && !c.AOFRewriteInProgress:
+		start := then - p.AOFCurrentRewriteTimeSec
+		events = append(events, PersistenceEvent{Timestamp: start + c.AOFLastRewriteTimeSec, Start: start, Kind: PersistAOFRewrite, Phase: PhaseEnd, Status: c.AOFLastBgrewriteStatus, DurationSec: c.AOFLastRewriteTimeSec, ForkUsec: cur.Stats.LatestForkUsec})
+	}
+	return events
+}
+
+// correlateForkSpikes returns the fork latency samples within
+// forkCorrelationWindow seconds of the start of the persistence event.
+func correlateForkSpikes(event PersistenceEvent, forks []LatencySample) (spikes []LatencySample) {
+	for _, sample := range forks {
+		if sample.Timestamp >= event.Start-forkCorrelationWindow && sample.Timestamp <= event.Start+forkCorrelationWindow {
+			spikes = append(spikes, sample)
+		}
+	}
+	return spikes
+}
+
+// trackPersistence records the persistence events found between two INFO
+// snapshots of the node on its timeline, correlated with its fork spikes.
+func (n *Node) trackPersistence(prev, cur RedisInfo) {
+	events := persistenceChanges(prev, cur)
+	if len(events) == 0 {
+		return
+	}
+	nodesLock.Lock()
+	forks := n.History["fork"]
+	for i := range events {
+		events[i].ForkSpikes = correlateForkSpikes(events[i], forks)
+	}
+	n.Persistence = append(n.Persistence, events...)
+	if len(n.Persistence) > maxPersistenceEvents {
+		n.Persistence = n.Persistence[len(n.Persistence)-maxPersistenceEvents:]
+	}
+	nodesLock.Unlock()
+	for _, event := range events {
+		text := fmt.Sprintf("%s %s at %s, fork took %dus", event.Kind, event.Phase, time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339), event.ForkUsec)
+		if event.Phase == PhaseEnd {
+			text += fmt.Sprintf(", ran %ds with status %s", event.DurationSec, event.Status)
+		}
+		for _, spike := range event.ForkSpikes {
+			text += fmt.Sprintf(", fork latency spike of %dms at %s", spike.Latency, time.Unix(spike.Timestamp, 0).UTC().Format(time.RFC3339))
+		}
+		annotate(n.Name, event.Kind+"-"+event.Phase, text)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollResult is the outcome of polling a single node
+type pollResult struct {
+	Node   *Node
+	Role   string
+	Latent bool
+	// Unmonitored is set if the node has latency monitoring disabled
+	Unmonitored bool
+	Err         error
+}
+
+// pollInFlight is set while a poll cycle is running
+var pollInFlight int32
+
+// readOnlyPoll is set by the one-shot commands, whose polls skip capturing
+// diagnostics
+var readOnlyPoll bool
+
+// runPollCycle runs checkForLatencyOnNodes unless the previous cycle is still
+// running, in which case this cycle is skipped.
+func runPollCycle() {
+	if !atomic.CompareAndSwapInt32(&pollInFlight, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&pollInFlight, 0)
+	checkForLatencyOnNodes()
+}
+
+// pollNodes polls the nodes with at most config.PollConcurrency at a time and
+// returns the result for each of them.
+func pollNodes(nodes []*Node) []pollResult {
+	jobs := make(chan *Node)
+	results := make(chan pollResult, len(nodes))
+	workers := config.PollConcurrency
+	if workers > len(nodes) {
+		workers = len(nodes)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range jobs {
+				results <- pollWithDeadline(node)
+			}
+		}()
+	}
+	for _, node := range nodes {
+		jobs <- node
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+	collected := make([]pollResult, 0, len(nodes))
+	for res := range results {
+		collected = append(collected, res)
+	}
+	return collected
+}
+
+// pollWithDeadline polls the node but gives up waiting after
+// config.NodeTimeout. A node whose poll was abandoned is not polled again
+// until that poll returns.
+func pollWithDeadline(node *Node) pollResult {
+	nodesLock.RLock()
+	role := node.Role
+	nodesLock.RUnlock()
+	if !node.startPoll() {
+		return pollResult{Node: node, Role: role, Err: fmt.Errorf("previous poll is still in flight")}
+	}
+	done := make(chan pollResult, 1)
+	go func() {
+		defer node.endPoll()
+		latent, err := node.poll(role)
+		done <- pollResult{Node: node, Role: role, Latent: latent, Unmonitored: !node.monitored(), Err: err}
+	}()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(config.NodeTimeout):
+		err := fmt.Errorf("poll timed out after %s", config.NodeTimeout)
+		node.recordTimeout(err)
+		return pollResult{Node: node, Role: role, Err: err}
+	}
+}
+
+func (n *Node) startPoll() bool {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	if n.polling {
+		return false
+	}
+	n.polling = true
+	return true
+}
+
+func (n *Node) endPoll() {
+	nodesLock.Lock()
+	n.polling = false
+	nodesLock.Unlock()
+}
+
+// recordTimeout marks the node as erroring without touching its connection,
+// which is still in use by the abandoned poll.
+func (n *Node) recordTimeout(err error) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	n.LastPoll = time.Now()
+	n.LastError = err.Error()
+	if n.State != NodeRemoved {
+		n.State = NodeErroring
+	}
+	n.Failures++
+}
+
+// poll collects and persists the node's latency data and reports whether the
+// node had any latency spikes.
+func (n *Node) poll(role string) (latent bool, err error) {
+	err = n.dial()
+	if err != nil {
+		return false, err
+	}
+	if role == RoleSentinel {
+		return false, n.checkSentinel()
+	}
+	conn, err := n.conn()
+	if err != nil {
+		return false, err
+	}
+	err = n.checkThreshold(conn)
+	if err != nil {
+		logger.Warning(n.Name + " - unable to check latency-monitor-threshold: " + err.Error())
+	}
+	started, err := n.collectLatency()
+	if err != nil {
+		return false, err
+	}
+	nodesLock.RLock()
+	latent = len(n.Events) > 0
+	nodesLock.RUnlock()
+	if started && !readOnlyPoll {
+		n.diagnoseNode()
+	}
+	err = n.collectSlowlog()
+	if err != nil {
+		logger.Warning(n.Name + " - unable to collect slowlog: " + err.Error())
+	}
+	err = n.collectInfo()
+	if err != nil {
+		logger.Warning(n.Name + " - unable to collect INFO: " + err.Error())
+	}
+	if store != nil {
+		err = n.persistLatency(store)
+		if err != nil {
+			logger.Warning(n.Name + " - unable to persist latency: " + err.Error())
+		}
+	}
+	for name, event := range n.Events {
+		logger.Info(fmt.Sprintf("%s - %s: %d spikes, latest %dms, max %dms", n.Name, name, len(n.History[name]), event.Latest, event.Max))
+	}
+	return latent, nil
+}
+
+// monitored reports whether the node has latency monitoring enabled
+func (n *Node) monitored() bool {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	return !n.unmonitored()
+}
+
+// unmonitored reports whether the node was found with latency monitoring
+// disabled. The caller must hold nodesLock.
+func (n *Node) unmonitored() bool {
+	return n.Role != RoleSentinel && n.thresholdChecked && n.Threshold == 0
+}
+
+// pollOnce loads the topology and polls every node once, for the one-shot
+// commands. The results are sorted by node name. The poll only looks: a
+// check run from cron must not change a node's config, reset latency data a
+// running daemon has yet to harvest or write to the store, so observe-only
+// and watermark mode are forced and the store is dropped.
+func pollOnce() []pollResult {
+	config.ObserveOnly = true
+	config.LatencyHarvestMode = HarvestWatermark
+	store = nil
+	readOnlyPoll = true
+	loadTopology(true)
+	nodesLock.RLock()
+	nodes := make([]*Node, 0, len(Nodes))
+	for _, node := range Nodes {
+		nodes = append(nodes, node)
+	}
+	nodesLock.RUnlock()
+	results := pollNodes(nodes)
+	sort.Slice(results, func(i, j int) bool { return results[i].Node.Name < results[j].Node.Name })
+	return results
+}
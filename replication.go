@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ReplicaLag is the replication state of a replica relative to its master
+type ReplicaLag struct {
+	Node             string
+	Offset           int64
+	LagBytes         int64
+	LastIOSecondsAgo int64
+	LinkStatus       string
+	LinkDown         bool
+	SyncInProgress   bool
+	Lagging          bool
+}
+
+// PodReplication is the replication state of every replica in a pod
+type PodReplication struct {
+	Pod          string
+	Master       string
+	MasterOffset int64
+	// FullSyncs is the master's sync_full, LastFullSync when it last grew
+	FullSyncs    int64
+	LastFullSync time.Time
+	Replicas     []ReplicaLag
+	Lagging      bool
+	// listed are the replicas in the master's INFO, by address
+	listed map[string]ReplicaInfo
+}
+
+// buildPodReplication computes the replication lag of every replica in each
+// pod from the latest INFO snapshots. The lag in bytes is taken from the
+// master's own snapshot, which lists each replica's acknowledged offset, as
+// the master and replica snapshots are taken at different times. A replica
+// the master doesn't list has no lag in bytes. The caller must hold
+// nodesLock.
+func buildPodReplication() map[string]*PodReplication {
+	pods := make(map[string]*PodReplication)
+	for _, node := range Nodes {
+		if node.Role == RoleSentinel || node.Pod.Name == "" || node.State == NodeRemoved {
+			continue
+		}
+		pod, exists := pods[node.Pod.Name]
+		if !exists {
+			pod = &PodReplication{Pod: node.Pod.Name, Master: node.Pod.Address()}
+			pods[node.Pod.Name] = pod
+		}
+		if node.Role == RoleMaster && node.Info != nil {
+			pod.MasterOffset = node.Info.Replication.MasterReplOffset
+			pod.FullSyncs = node.Info.Stats.SyncFull
+			pod.LastFullSync = node.LastFullSync
+			pod.listed = make(map[string]ReplicaInfo)
+			for _, replica := range node.Info.Replication.Replicas {
+				pod.listed[replica.Addr] = replica
+			}
+		}
+	}
+	for _, node := range Nodes {
+		if node.Role != RoleReplica || node.Info == nil || node.State == NodeRemoved {
+			continue
+		}
+		pod, exists := pods[node.Pod.Name]
+		if !exists {
+			continue
+		}
+		repl := node.Info.Replication
+		lag := ReplicaLag{
+			Node:             node.Name,
+			Offset:           repl.SlaveReplOffset,
+			LastIOSecondsAgo: repl.MasterLastIOSecondsAgo,
+			LinkStatus:       repl.MasterLinkStatus,
+			LinkDown:         repl.MasterLinkStatus != "up",
+			SyncInProgress:   repl.MasterSyncInProgress,
+		}
+		if listed, exists := pod.listed[node.Name]; exists && pod.MasterOffset > 0 {
+			lag.LagBytes = pod.MasterOffset - listed.Offset
+			if lag.LagBytes < 0 {
+				lag.LagBytes = 0
+			}
+		}
+		lag.Lagging = lag.LinkDown || lag.SyncInProgress || lag.LagBytes > config.ReplicationLagBytes
+		if lag.Lagging {
+			pod.Lagging = true
+		}
+		pod.Replicas = append(pod.Replicas, lag)
+	}
+	for _, pod := range pods {
+		sort.Slice(pod.Replicas, func(i, j int) bool { return pod.Replicas[i].Node < pod.Replicas[j].Node })
+	}
+	return pods
+}
+
+// checkReplicationChanges annotates replication changes between two INFO
+// snapshots of the node: the replica link going down or coming back, and
+// full resyncs served by a master.
+func (n *Node) checkReplicationChanges(prev, cur RedisInfo) {
+	if cur.Stats.SyncFull > prev.Stats.SyncFull {
+		nodesLock.Lock()
+		n.LastFullSync = cur.Timestamp
+		nodesLock.Unlock()
+		annotate(n.Name, "full-resync", fmt.Sprintf("%d full resyncs served since the last poll", cur.Stats.SyncFull-prev.Stats.SyncFull))
+	}
+	if cur.Replication.Role != "slave" || prev.Replication.Role != "slave" {
+		return
+	}
+	if prev.Replication.MasterLinkStatus == "up" && cur.Replication.MasterLinkStatus != "up" {
+		annotate(n.Name, "replication-link-down", fmt.Sprintf("link to master %s:%d is %s", cur.Replication.MasterHost, cur.Replication.MasterPort, cur.Replication.MasterLinkStatus))
+	} else if prev.Replication.MasterLinkStatus != "up" && cur.Replication.MasterLinkStatus == "up" {
+		annotate(n.Name, "replication-link-up", fmt.Sprintf("link to master %s:%d is up", cur.Replication.MasterHost, cur.Replication.MasterPort))
+	}
+}
+
+func handleReplication(w http.ResponseWriter, r *http.Request) {
+	nodesLock.RLock()
+	pods := buildPodReplication()
+	nodesLock.RUnlock()
+	sorted := []*PodReplication{}
+	for _, pod := range pods {
+		sorted = append(sorted, pod)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Pod < sorted[j].Pod })
+	writeJSON(w, http.StatusOK, sorted)
+}
+
+// writeReplicationMetrics writes the replication state of every replica.
+// The caller must hold nodesLock.
+func writeReplicationMetrics(m metricWriter) {
+	pods := buildPodReplication()
+	names := make([]string, 0, len(pods))
+	for name := range pods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.header("candui_replication_lag_bytes", "gauge", "Bytes the replica is behind its master's replication offset.")
+	for _, name := range names {
+		for _, lag := range pods[name].Replicas {
+			m.sample("candui_replication_lag_bytes", lag.LagBytes, "pod", name, "node", lag.Node)
+		}
+	}
+	m.header("candui_replication_last_io_seconds", "gauge", "Seconds since the replica last heard from its master.")
+	for _, name := range names {
+		for _, lag := range pods[name].Replicas {
+			m.sample("candui_replication_last_io_seconds", lag.LastIOSecondsAgo, "pod", name, "node", lag.Node)
+		}
+	}
+	m.header("candui_replication_link_up", "gauge", "Whether the replica's link to its master is up.")
+	for _, name := range names {
+		for _, lag := range pods[name].Replicas {
+			up := 1
+			if lag.LinkDown {
+				up = 0
+			}
+			m.sample("candui_replication_link_up", up, "pod", name, "node", lag.Node)
+		}
+	}
+	m.header("candui_replication_full_syncs_total", "counter", "Full resyncs served by the pod's master.")
+	for _, name := range names {
+		m.sample("candui_replication_full_syncs_total", pods[name].FullSyncs, "pod", name, "node", pods[name].Master)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// scheduleTick is how often the scheduler looks for nodes due to be polled
+const scheduleTick = time.Second
+
+// pollJitter is the fraction of a node's interval its polls are randomly
+// shifted by so nodes sharing an interval aren't all hit at once.
+const pollJitter = 0.1
+
+// lastTopologyRefresh is when the topology was last reloaded
+var lastTopologyRefresh time.Time
+
+// podInterval returns the poll interval for the pod, honoring the per-pod
+// overrides in config.PodIntervals.
+func podInterval(podname string) time.Duration {
+	interval, exists := config.PodIntervals[podname]
+	if exists && interval > 0 {
+		return interval
+	}
+	return config.PollInterval
+}
+
+// jitter returns the interval shifted randomly by up to pollJitter of it in
+// either direction.
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(float64(interval) * pollJitter)
+	if spread <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(2*spread)-spread)
+}
+
+// dueNodes returns the nodes whose next poll time has passed and schedules
+// their following poll. Nodes without a connection are skipped until their
+// redial backoff expires; the poll dials them. Removed nodes are not polled,
+// and are dropped here once they have been visible long enough. Nodes which
+// have never been scheduled get a random first poll time within their
+// interval to spread the load.
+func dueNodes(now time.Time) (due []*Node) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	dropRemovedNodes(now)
+	for _, node := range Nodes {
+		if node.State == NodeRemoved {
+			continue
+		}
+		if node.Connection == nil && now.Before(node.NextDial) {
+			continue
+		}
+		interval := podInterval(node.Pod.Name)
+		if node.NextPoll.IsZero() {
+			node.NextPoll = now.Add(time.Duration(rand.Int63n(int64(interval))))
+			continue
+		}
+		if now.Before(node.NextPoll) {
+			continue
+		}
+		node.NextPoll = now.Add(jitter(interval))
+		due = append(due, node)
+	}
+	return due
+}
@@ -12,12 +12,26 @@ import (
 // SentinelPodConfig is a struct carrying information about a Pod's config as
 // pulled from the sentinel config file.
 type SentinelPodConfig struct {
-	IP        string
-	Port      int
-	Quorum    int
-	Name      string
-	AuthToken string
-	Sentinels map[string]string
+	IP            string
+	Port          int
+	Quorum        int
+	Name          string
+	AuthToken     string
+	AuthUser      string
+	Sentinels     map[string]string
+	KnownReplicas []string
+
+	DownAfterMilliseconds int
+	FailoverTimeout       int
+	ParallelSyncs         int
+	NotificationScript    string
+	ClientReconfigScript  string
+	ConfigEpoch           int64
+	LeaderEpoch           int64
+	// RenameCommands maps original command names to their renamed form
+	RenameCommands map[string]string
+	// Options holds any other per pod directive, keyed by directive name
+	Options map[string][]string
 }
 
 // SentinelConfig is a struct holding information about the sentinel we are
@@ -25,99 +39,451 @@ type SentinelPodConfig struct {
 type SentinelConfig struct {
 	Name              string
 	Host              string
+	Binds             []string
 	Port              int
 	ManagedPodConfigs map[string]SentinelPodConfig
 	Dir               string
+
+	MyID              string
+	CurrentEpoch      int64
+	AnnounceIP        string
+	AnnouncePort      int
+	DenyScripts       bool
+	ResolveHostnames  bool
+	AnnounceHostnames bool
+	SentinelUser      string
+	SentinelPass      string
+	// Options holds every other top level or sentinel directive, keyed by
+	// directive name with sentinel directives prefixed by "sentinel "
+	Options map[string][]string
+}
+
+// ConfigError describes a line of a sentinel config which couldn't be parsed
+type ConfigError struct {
+	File string
+	Line int
+	Text string
+	Err  string
 }
 
-var sconfig SentinelConfig
+func (e *ConfigError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s: %q", e.Line, e.Err, e.Text)
+	}
+	return fmt.Sprintf("%s:%d: %s: %q", e.File, e.Line, e.Err, e.Text)
+}
 
 // syncableDirectives is the list of directives to sync
 // ideally this should also be controllable per invocation
 var syncableDirectives []string
 
-// extractSentinelDirective parses the sentinel directives from the
-// sentinel config file
-func extractSentinelDirective(entries []string) error {
-	switch entries[0] {
+// NewSentinelConfig returns an empty SentinelConfig
+func NewSentinelConfig() *SentinelConfig {
+	return &SentinelConfig{
+		ManagedPodConfigs: make(map[string]SentinelPodConfig),
+		Options:           make(map[string][]string),
+	}
+}
+
+// splitConfigLine splits a config line into its arguments the way Redis
+// does. Arguments may be double quoted, with backslash escapes, or single
+// quoted. A '#' at the start of an unquoted argument begins a comment which
+// runs to the end of the line; anywhere else it is part of the argument.
+func splitConfigLine(line string) (args []string, err error) {
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '\r' || line[i] == '\n') {
+			i++
+		}
+		if i >= len(line) || line[i] == '#' {
+			return args, nil
+		}
+		var arg []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced double quotes")
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case line[i] == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("closing quote must be followed by a space")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced single quotes")
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("closing quote must be followed by a space")
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\t', '\r', '\n':
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// needArgs returns an error unless entries has at least n arguments
+func needArgs(entries []string, n int) error {
+	if len(entries) < n {
+		return fmt.Errorf("%s needs %d arguments, got %d", entries[0], n-1, len(entries)-1)
+	}
+	return nil
+}
+
+func atoi(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return v, nil
+}
+
+func atoi64(s string) (int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return v, nil
+}
+
+func yesno(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not yes or no", s)
+}
+
+// podDirectives are the sentinel directives which apply to a monitored pod
+var podDirectives = map[string]bool{
+	"auth-pass": true, "auth-user": true, "down-after-milliseconds": true,
+	"failover-timeout": true, "parallel-syncs": true, "config-epoch": true,
+	"leader-epoch": true, "notification-script": true,
+	"client-reconfig-script": true, "known-slave": true, "known-replica": true,
+	"known-sentinel": true, "rename-command": true,
+	"master-reboot-down-after-period": true,
+}
+
+// extractSentinelDirective parses a sentinel directive, the arguments after
+// "sentinel", into the config.
+func (sc *SentinelConfig) extractSentinelDirective(entries []string) error {
+	if len(entries) == 0 {
+		return fmt.Errorf("empty sentinel directive")
+	}
+	directive := strings.ToLower(entries[0])
+	var err error
+	switch directive {
 	case "monitor":
-		pname := entries[1]
-		port, _ := strconv.Atoi(entries[3])
-		quorum, _ := strconv.Atoi(entries[4])
-		spc := SentinelPodConfig{Name: pname, IP: entries[2], Port: port, Quorum: quorum}
+		if err = needArgs(entries, 5); err != nil {
+			return err
+		}
+		spc := SentinelPodConfig{Name: entries[1], IP: entries[2]}
+		if spc.Port, err = atoi(entries[3]); err != nil {
+			return err
+		}
+		if spc.Quorum, err = atoi(entries[4]); err != nil {
+			return err
+		}
 		spc.Sentinels = make(map[string]string)
-		addr := fmt.Sprintf("%s:%d", entries[2], port)
-		_, exists := sconfig.ManagedPodConfigs[addr]
-		if !exists {
-			sconfig.ManagedPodConfigs[entries[1]] = spc
+		spc.RenameCommands = make(map[string]string)
+		spc.Options = make(map[string][]string)
+		sc.ManagedPodConfigs[spc.Name] = spc
+		return nil
+
+	case "myid":
+		if err = needArgs(entries, 2); err != nil {
+			return err
 		}
+		sc.MyID = entries[1]
 		return nil
 
-	case "auth-pass":
-		pname := entries[1]
-		pc := sconfig.ManagedPodConfigs[pname]
-		pc.AuthToken = entries[2]
-		sconfig.ManagedPodConfigs[pname] = pc
+	case "current-epoch":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.CurrentEpoch, err = atoi64(entries[1])
+		return err
+
+	case "announce-ip":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.AnnounceIP = entries[1]
 		return nil
 
-	case "config-epoch", "leader-epoch", "current-epoch", "down-after-milliseconds", "known-sentinel", "known-slave":
-		// We don't use these keys
+	case "announce-port":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.AnnouncePort, err = atoi(entries[1])
+		return err
+
+	case "deny-scripts-reconfig", "resolve-hostnames", "announce-hostnames":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		value, err := yesno(entries[1])
+		if err != nil {
+			return err
+		}
+		switch directive {
+		case "deny-scripts-reconfig":
+			sc.DenyScripts = value
+		case "resolve-hostnames":
+			sc.ResolveHostnames = value
+		case "announce-hostnames":
+			sc.AnnounceHostnames = value
+		}
 		return nil
 
-	default:
-		err := fmt.Errorf("Unhandled sentinel directive: %+v", entries)
-		logger.Warning(err.Error())
+	case "sentinel-user":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.SentinelUser = entries[1]
+		return nil
+
+	case "sentinel-pass":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.SentinelPass = entries[1]
 		return nil
 	}
-}
 
-// LoadSentinelConfigFile loads the local config file pulled from the
-// environment variable "CONFIGSYNC_SENTINELCONFIGFILE"
-func LoadSentinelConfigFile() error {
-	file, err := os.Open(config.SentinelConfigFile)
-	defer file.Close()
-	if err != nil {
-		logger.Crit(err.Error())
-		os.Exit(1)
+	// everything else applies to a pod
+	if err = needArgs(entries, 2); err != nil {
+		return err
 	}
-	bf := bufio.NewReader(file)
-	for {
-		rawline, err := bf.ReadString('\n')
-		if err == nil || err == io.EOF {
-			line := strings.TrimSpace(rawline)
-			// ignore comments
-			if strings.Contains(line, "#") {
-				continue
-			}
-			entries := strings.Split(line, " ")
-			//Most values are key/value pairs
-			switch entries[0] {
-			case "sentinel": // Have a sentinel directive
-				err := extractSentinelDirective(entries[1:])
-				if err != nil {
-					// TODO: Fix this to return a different error if we can't
-					// connect to the sentinel
-					logger.Warning("Misshapen sentinel directive: " + line + " err: " + err.Error())
-				}
-			case "port":
-				iport, _ := strconv.Atoi(entries[1])
-				sconfig.Port = iport
-				//logger.Warning("Local sentinel is bound to port %d", sconfig.Port)
-			case "dir":
-				sconfig.Dir = entries[1]
-			case "bind":
-				sconfig.Host = entries[1]
-			case "":
-				if err == io.EOF {
-					return nil
-				}
-			default:
-				logger.Warning("UNhandled Sentinel Directive: %s" + line)
-			}
+	pname := entries[1]
+	pc, exists := sc.ManagedPodConfigs[pname]
+	if !exists {
+		if !podDirectives[directive] {
+			// a global directive we don't model
+			sc.Options["sentinel "+directive] = entries[1:]
+			return nil
+		}
+		return fmt.Errorf("no monitor directive for pod %s before %s", pname, directive)
+	}
+	switch directive {
+	case "auth-pass":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		pc.AuthToken = entries[2]
+
+	case "auth-user":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		pc.AuthUser = entries[2]
+
+	case "down-after-milliseconds", "failover-timeout", "parallel-syncs":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		value, err := atoi(entries[2])
+		if err != nil {
+			return err
+		}
+		switch directive {
+		case "down-after-milliseconds":
+			pc.DownAfterMilliseconds = value
+		case "failover-timeout":
+			pc.FailoverTimeout = value
+		case "parallel-syncs":
+			pc.ParallelSyncs = value
+		}
+
+	case "config-epoch", "leader-epoch":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		value, err := atoi64(entries[2])
+		if err != nil {
+			return err
+		}
+		if directive == "config-epoch" {
+			pc.ConfigEpoch = value
 		} else {
-			logger.Warning("=============== LOAD FILE ERROR ===============")
-			logger.Crit(err.Error())
-			os.Exit(1)
+			pc.LeaderEpoch = value
+		}
+
+	case "notification-script":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		pc.NotificationScript = entries[2]
+
+	case "client-reconfig-script":
+		if err = needArgs(entries, 3); err != nil {
+			return err
+		}
+		pc.ClientReconfigScript = entries[2]
+
+	case "known-slave", "known-replica":
+		if err = needArgs(entries, 4); err != nil {
+			return err
+		}
+		if _, err = atoi(entries[3]); err != nil {
+			return err
+		}
+		pc.KnownReplicas = append(pc.KnownReplicas, entries[2]+":"+entries[3])
+
+	case "known-sentinel":
+		// known-sentinel <pod> <ip> <port> [runid]
+		if err = needArgs(entries, 4); err != nil {
+			return err
+		}
+		if _, err = atoi(entries[3]); err != nil {
+			return err
+		}
+		runid := ""
+		if len(entries) > 4 {
+			runid = entries[4]
+		}
+		pc.Sentinels[entries[2]+":"+entries[3]] = runid
+
+	case "rename-command":
+		if err = needArgs(entries, 4); err != nil {
+			return err
+		}
+		pc.RenameCommands[strings.ToUpper(entries[2])] = entries[3]
+
+	default:
+		// master-reboot-down-after-period and whatever future versions add
+		pc.Options[directive] = entries[2:]
+	}
+	sc.ManagedPodConfigs[pname] = pc
+	return nil
+}
+
+// parseLine applies a single split config line to the config
+func (sc *SentinelConfig) parseLine(entries []string) error {
+	var err error
+	switch strings.ToLower(entries[0]) {
+	case "sentinel": // Have a sentinel directive
+		return sc.extractSentinelDirective(entries[1:])
+	case "port":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.Port, err = atoi(entries[1])
+		return err
+	case "dir":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.Dir = entries[1]
+	case "bind":
+		if err = needArgs(entries, 2); err != nil {
+			return err
+		}
+		sc.Binds = entries[1:]
+		sc.Host = entries[1]
+	default:
+		sc.Options[strings.ToLower(entries[0])] = entries[1:]
+	}
+	return nil
+}
+
+// ParseSentinelConfig parses a sentinel config. The first line which can't
+// be parsed is returned as a *ConfigError.
+func ParseSentinelConfig(r io.Reader) (*SentinelConfig, error) {
+	sc := NewSentinelConfig()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		entries, err := splitConfigLine(line)
+		if err == nil && len(entries) > 0 {
+			err = sc.parseLine(entries)
+		}
+		if err != nil {
+			return sc, &ConfigError{Line: lineno, Text: strings.TrimSpace(line), Err: err.Error()}
 		}
 	}
+	return sc, scanner.Err()
+}
+
+// LoadSentinelConfig reads and parses the sentinel config file
+func LoadSentinelConfig(filename string) (*SentinelConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sc, err := ParseSentinelConfig(file)
+	if cerr, ok := err.(*ConfigError); ok {
+		cerr.File = filename
+	}
+	return sc, err
+}
+
+// Address returns the host:port of the pod's master
+func (p SentinelPodConfig) Address() string {
+	return fmt.Sprintf("%s:%d", p.IP, p.Port)
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitConfigLine(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  string
+	}{
+		{line: "", args: nil},
+		{line: "   # a comment", args: nil},
+		{line: "port 26379", args: []string{"port", "26379"}},
+		{line: "\tsentinel  monitor pod1 10.0.0.1 6379 2  ", args: []string{"sentinel", "monitor", "pod1", "10.0.0.1", "6379", "2"}},
+		{line: "sentinel monitor pod1 10.0.0.1 6379 2 # the primary", args: []string{"sentinel", "monitor", "pod1", "10.0.0.1", "6379", "2"}},
+		{line: "sentinel auth-pass pod1 abc#123", args: []string{"sentinel", "auth-pass", "pod1", "abc#123"}},
+		{line: `sentinel auth-pass pod1 "p#ss word"`, args: []string{"sentinel", "auth-pass", "pod1", "p#ss word"}},
+		{line: `dir "/var/lib/redis"`, args: []string{"dir", "/var/lib/redis"}},
+		{line: `x "a\"b\n\x41"`, args: []string{"x", "a\"b\nA"}},
+		{line: `x 'it\'s' ''`, args: []string{"x", "it's", ""}},
+		{line: `x "unterminated`, err: "unbalanced double quotes"},
+		{line: `x 'unterminated`, err: "unbalanced single quotes"},
+		{line: `x "a"b`, err: "closing quote must be followed by a space"},
+		{line: `x 'a'b`, err: "closing quote must be followed by a space"},
+	}
+	for _, tt := range tests {
+		args, err := splitConfigLine(tt.line)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("splitConfigLine(%q) error = %v, want %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitConfigLine(%q) error = %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("splitConfigLine(%q) = %q, want %q", tt.line, args, tt.args)
+		}
+	}
+}
+
+func TestParseSentinelConfig(t *testing.T) {
+	tests := []struct {
+		file string
+		pods map[string]SentinelPodConfig
+	}{
+		{
+			file: "redis-2.8-stock.conf",
+			pods: map[string]SentinelPodConfig{
+				"mymaster": {
+					IP: "127.0.0.1", Port: 6379, Quorum: 2, Name: "mymaster",
+					Sentinels:             map[string]string{},
+					DownAfterMilliseconds: 30000, FailoverTimeout: 180000, ParallelSyncs: 1,
+					RenameCommands: map[string]string{},
+					Options:        map[string][]string{},
+				},
+			},
+		},
+		{
+			file: "redis-3.2-rewritten.conf",
+			pods: map[string]SentinelPodConfig{
+				"pod1": {
+					IP: "10.0.1.10", Port: 6379, Quorum: 2, Name: "pod1", AuthToken: "s3cr3t",
+					Sentinels: map[string]string{
+						"10.0.1.21:26379": "8a3c2a4b86a5aa6e5a3b4a5ac02b2ec7e2f2e2f1",
+						"10.0.1.22:26379": "2f7d1d0b08f6cc1c6b7e4e0ad3b8a9c3b0c1e5d2",
+					},
+					KnownReplicas:         []string{"10.0.1.11:6379", "10.0.1.12:6379"},
+					DownAfterMilliseconds: 5000, FailoverTimeout: 60000,
+					ConfigEpoch: 4, LeaderEpoch: 4,
+					RenameCommands: map[string]string{},
+					Options:        map[string][]string{},
+				},
+				"pod2": {
+					IP: "10.0.2.10", Port: 6380, Quorum: 2, Name: "pod2",
+					Sentinels: map[string]string{
+						"10.0.1.21:26379": "8a3c2a4b86a5aa6e5a3b4a5ac02b2ec7e2f2e2f1",
+						"10.0.1.22:26379": "2f7d1d0b08f6cc1c6b7e4e0ad3b8a9c3b0c1e5d2",
+					},
+					KnownReplicas:         []string{"10.0.2.11:6380"},
+					DownAfterMilliseconds: 5000, FailoverTimeout: 60000,
+					RenameCommands: map[string]string{},
+					Options:        map[string][]string{},
+				},
+			},
+		},
+		{
+			file: "redis-6.2-rewritten.conf",
+			pods: map[string]SentinelPodConfig{
+				"sessions": {
+					IP: "10.0.3.10", Port: 6379, Quorum: 2, Name: "sessions",
+					AuthToken: "p#ss word", AuthUser: "candui",
+					Sentinels: map[string]string{
+						"10.0.3.21:26379": "7d0c3f5c7e7b6bb0d3b2b1a2d7c5e6f1a2b3c4d5",
+						"10.0.3.22:26379": "e1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4",
+					},
+					KnownReplicas:         []string{"10.0.3.11:6379", "10.0.3.12:6379"},
+					DownAfterMilliseconds: 10000, ParallelSyncs: 2,
+					NotificationScript:   "/etc/redis/notify.sh",
+					ClientReconfigScript: "/etc/redis/reconfig.sh",
+					ConfigEpoch:          12, LeaderEpoch: 12,
+					RenameCommands: map[string]string{"CONFIG": "GUESSME", "SLAVEOF": ""},
+					Options:        map[string][]string{"master-reboot-down-after-period": {"0"}},
+				},
+			},
+		},
+		{
+			file: "hostnames.conf",
+			pods: map[string]SentinelPodConfig{
+				"cache": {
+					IP: "redis-0.redis.cache.svc.cluster.local", Port: 6379, Quorum: 2, Name: "cache",
+					AuthToken: "abc#123",
+					Sentinels: map[string]string{
+						"redis-sentinel-1.redis-sentinel.cache.svc.cluster.local:26379": "4ef2c0e7a9c2b1d8e3f4a5b6c7d8e9f0a1b2c3d4",
+					},
+					KnownReplicas: []string{
+						"redis-1.redis.cache.svc.cluster.local:6379",
+						"redis-2.redis.cache.svc.cluster.local:6379",
+					},
+					DownAfterMilliseconds: 5000, FailoverTimeout: 20000,
+					RenameCommands: map[string]string{},
+					Options:        map[string][]string{},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		sc, err := LoadSentinelConfig(filepath.Join("testdata", "sentinel", tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(sc.ManagedPodConfigs, tt.pods) {
+			t.Errorf("%s: pods = %+v, want %+v", tt.file, sc.ManagedPodConfigs, tt.pods)
+		}
+	}
+}
+
+func TestParseSentinelConfigErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		line int
+		err  string
+	}{
+		{file: "invalid-missing-monitor.conf", line: 2, err: "no monitor directive for pod ghost"},
+		{file: "invalid-unbalanced-quotes.conf", line: 3, err: "unbalanced double quotes"},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join("testdata", "sentinel", tt.file)
+		_, err := LoadSentinelConfig(filename)
+		cerr, ok := err.(*ConfigError)
+		if !ok {
+			t.Errorf("%s: error = %v, want a *ConfigError", tt.file, err)
+			continue
+		}
+		if cerr.File != filename || cerr.Line != tt.line || !strings.Contains(cerr.Err, tt.err) {
+			t.Errorf("%s: error = %v, want line %d: %s", tt.file, cerr, tt.line, tt.err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// SlowlogEntry is an entry from SLOWLOG GET. Duration is in microseconds.
+type SlowlogEntry struct {
+	ID         int64
+	Timestamp  int64
+	Duration   int64
+	Command    string
+	Args       []string
+	ClientAddr string
+	ClientName string
+}
+
+// maxSlowlogEntries is the number of slowlog entries kept in memory per node
+const maxSlowlogEntries = 128
+
+// redactedCommands always have all of their arguments redacted
+var redactedCommands = map[string]bool{"auth": true, "hello": true, "migrate": true, "acl": true, "config": true}
+
+// sanitizeArgs truncates and redacts slowlog arguments according to the
+// config. The first argument, usually the key, is kept unless the command
+// is always redacted.
+func sanitizeArgs(command string, args []string) []string {
+	if redactedCommands[strings.ToLower(command)] {
+		if len(args) == 0 {
+			return args
+		}
+		return []string{"(redacted)"}
+	}
+	sanitized := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i >= config.SlowlogMaxArgs {
+			sanitized = append(sanitized, fmt.Sprintf("(%d more arguments)", len(args)-i))
+			break
+		}
+		if config.SlowlogRedactArgs && i > 0 {
+			arg = "?"
+		} else if len(arg) > config.SlowlogMaxArgLength {
+			arg = fmt.Sprintf("%s...(%d more bytes)", arg[:config.SlowlogMaxArgLength], len(arg)-config.SlowlogMaxArgLength)
+		}
+		sanitized = append(sanitized, arg)
+	}
+	return sanitized
+}
+
+// getSlowlog calls SLOWLOG GET for up to count entries, newest first
+func getSlowlog(conn *client.Redis, count int) (entries []SlowlogEntry, err error) {
+	rp, err := conn.ExecuteCommand("SLOWLOG", "GET", count)
+	if err != nil {
+		return entries, err
+	}
+	items, err := rp.MultiValue()
+	if err != nil {
+		return entries, err
+	}
+	for _, item := range items {
+		if len(item.Multi) < 4 {
+			return entries, fmt.Errorf("Malformed SLOWLOG entry: %+v", item)
+		}
+		entry := SlowlogEntry{
+			ID:        item.Multi[0].Integer,
+			Timestamp: item.Multi[1].Integer,
+			Duration:  item.Multi[2].Integer,
+		}
+		var args []string
+		for _, arg := range item.Multi[3].Multi {
+			args = append(args, string(arg.Bulk))
+		}
+		if len(args) > 0 {
+			entry.Command = args[0]
+			entry.Args = sanitizeArgs(args[0], args[1:])
+		}
+		// client details were added in Redis 4.0
+		if len(item.Multi) >= 6 {
+			entry.ClientAddr = string(item.Multi[4].Bulk)
+			entry.ClientName = string(item.Multi[5].Bulk)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// collectSlowlog fetches the node's slowlog and keeps and stores the entries
+// newer than the node's slowlog watermark. If the newest ID is below the
+// watermark the node has restarted and the watermark starts over.
+func (n *Node) collectSlowlog() error {
+	conn, err := n.conn()
+	if err != nil {
+		return err
+	}
+	entries, err := getSlowlog(conn, config.SlowlogCount)
+	if err != nil {
+		return err
+	}
+	nodesLock.RLock()
+	watermark := n.SlowlogID
+	nodesLock.RUnlock()
+	if len(entries) > 0 && entries[0].ID < watermark {
+		watermark = -1
+	}
+	// entries come newest first, store them oldest first
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.ID <= watermark {
+			continue
+		}
+		if store != nil {
+			err = store.StoreSlowlogEntry(n.Name, entry)
+			if err != nil {
+				return err
+			}
+		}
+		nodesLock.Lock()
+		n.SlowlogID = entry.ID
+		n.Slowlog = append(n.Slowlog, entry)
+		if len(n.Slowlog) > maxSlowlogEntries {
+			n.Slowlog = n.Slowlog[len(n.Slowlog)-maxSlowlogEntries:]
+		}
+		nodesLock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TopologySource is somewhere pod configs are loaded from: a sentinel config
+// file or a live sentinel.
+type TopologySource struct {
+	Name string
+	Pods map[string]SentinelPodConfig
+	// Sentinel is the address of the sentinel the source belongs to, if known
+	Sentinel string
+	Error    string
+	Loaded   time.Time
+}
+
+// PodConflict is a pod name which sources disagree on the master of
+type PodConflict struct {
+	Pod string
+	// Source is the source whose master is used
+	Source string
+	// Masters maps each source to the master address it has for the pod
+	Masters map[string]string
+}
+
+func (c PodConflict) String() string {
+	names := make([]string, 0, len(c.Masters))
+	for name := range c.Masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+c.Masters[name])
+	}
+	return fmt.Sprintf("pod %s has conflicting masters: %s, using %s", c.Pod, strings.Join(parts, ", "), c.Source)
+}
+
+// topology state, guarded by sourcesLock
+var (
+	sources      = make(map[string]*TopologySource)
+	sourcePods   = make(map[string]SentinelPodConfig)
+	podConflicts []PodConflict
+	sourcesLock  sync.Mutex
+)
+
+// fileSourcePatterns returns the configured sentinel config files,
+// directories and globs.
+func fileSourcePatterns() []string {
+	var patterns []string
+	if config.SentinelConfigFile != "" {
+		patterns = append(patterns, config.SentinelConfigFile)
+	}
+	return append(patterns, config.SentinelConfigFiles...)
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// expandConfigPaths turns the patterns into the config files they name. A
+// directory names every *.conf file in it. A plain path is returned even if
+// it doesn't exist so the failure to load it is reported.
+func expandConfigPaths(patterns []string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(path string) {
+		path = filepath.Clean(path)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for _, pattern := range patterns {
+		if isGlob(pattern) {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				logger.Warning("Invalid sentinel config glob " + pattern + ": " + err.Error())
+			}
+			for _, match := range matches {
+				add(match)
+			}
+			continue
+		}
+		info, err := os.Stat(pattern)
+		if err == nil && info.IsDir() {
+			matches, _ := filepath.Glob(filepath.Join(pattern, "*.conf"))
+			for _, match := range matches {
+				add(match)
+			}
+			continue
+		}
+		add(pattern)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// isConfigSourceFile reports whether a changed file is one of the sentinel
+// config sources, or would become one.
+func isConfigSourceFile(name string) bool {
+	name = filepath.Clean(name)
+	for _, pattern := range fileSourcePatterns() {
+		if isGlob(pattern) {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+			continue
+		}
+		pattern = filepath.Clean(pattern)
+		if name == pattern {
+			return true
+		}
+		if filepath.Dir(name) == pattern && filepath.Ext(name) == ".conf" {
+			return true
+		}
+	}
+	return false
+}
+
+// globPrefix returns the deepest directory of a glob with no wildcard in it
+func globPrefix(pattern string) string {
+	for isGlob(pattern) {
+		pattern = filepath.Dir(pattern)
+	}
+	return pattern
+}
+
+// isSourceDir reports whether a directory matches the directory part of a
+// glob source, such as /srv/a for /srv/*/sentinel.conf, and so should be
+// watched once it is created.
+func isSourceDir(name string) bool {
+	name = filepath.Clean(name)
+	for _, pattern := range fileSourcePatterns() {
+		if !isGlob(pattern) {
+			continue
+		}
+		if matched, _ := filepath.Match(filepath.Dir(filepath.Clean(pattern)), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// watchDirs returns the directories to watch for changes to the sources.
+// For a glob with a wildcard in its directory part these are the deepest
+// directory with no wildcard and the directories currently matching.
+func watchDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, pattern := range fileSourcePatterns() {
+		dir := filepath.Dir(filepath.Clean(pattern))
+		if isGlob(pattern) {
+			if !isGlob(dir) {
+				add(dir)
+				continue
+			}
+			add(globPrefix(dir))
+			matches, _ := filepath.Glob(dir)
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && info.IsDir() {
+					add(match)
+				}
+			}
+			continue
+		}
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			dir = filepath.Clean(pattern)
+		}
+		add(dir)
+	}
+	return dirs
+}
+
+// loadFileSource loads a sentinel config file. If it fails the pods of the
+// previous load are kept so a bad edit doesn't drop them.
+func loadFileSource(path string, prev *TopologySource) *TopologySource {
+	src := &TopologySource{Name: "file:" + path, Loaded: time.Now()}
+	sc, err := LoadSentinelConfig(path)
+	if err != nil {
+		src.Error = err.Error()
+		if prev != nil {
+			src.Pods = prev.Pods
+			src.Sentinel = prev.Sentinel
+		}
+		return src
+	}
+	src.Pods = sc.ManagedPodConfigs
+	if sc.Port > 0 {
+		host := sc.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		src.Sentinel = fmt.Sprintf("%s:%d", host, sc.Port)
+	}
+	return src
+}
+
+// loadLiveSource discovers the pods known to a live sentinel, keeping the
+// previous pods if it can't be reached.
+func loadLiveSource(addr string, prev *TopologySource) *TopologySource {
+	src := &TopologySource{Name: "sentinel:" + addr, Sentinel: addr, Loaded: time.Now()}
+	pods, err := discoverFromSentinel(addr)
+	if err != nil {
+		src.Error = err.Error()
+		if prev != nil {
+			src.Pods = prev.Pods
+		}
+		return src
+	}
+	src.Pods = pods
+	return src
+}
+
+// copyPod returns a copy of the pod config which shares no maps or slices
+func copyPod(pod SentinelPodConfig) SentinelPodConfig {
+	pod.KnownReplicas = append([]string(nil), pod.KnownReplicas...)
+	sentinels := make(map[string]string)
+	for addr, runid := range pod.Sentinels {
+		sentinels[addr] = runid
+	}
+	pod.Sentinels = sentinels
+	return pod
+}
+
+// live reports whether the source is a sentinel which answered the last
+// time it was queried
+func (src *TopologySource) live() bool {
+	return strings.HasPrefix(src.Name, "sentinel:") && src.Error == ""
+}
+
+// sourcePod is a pod config as given by one source
+type sourcePod struct {
+	source *TopologySource
+	pod    SentinelPodConfig
+}
+
+// preferredOver reports whether p's view of a pod should win over q's: the
+// highest config-epoch wins as it has seen the latest failover, then a live
+// sentinel over a file or an unreachable sentinel, then the first source by
+// name.
+func (p sourcePod) preferredOver(q sourcePod) bool {
+	if p.pod.ConfigEpoch != q.pod.ConfigEpoch {
+		return p.pod.ConfigEpoch > q.pod.ConfigEpoch
+	}
+	if p.source.live() != q.source.live() {
+		return p.source.live()
+	}
+	return p.source.Name < q.source.Name
+}
+
+// mergeSources merges the pods of every source by name. Sources which agree
+// on a pod's master contribute their replicas and sentinels to it; sources
+// which disagree are reported as a conflict and the master of the preferred
+// source is kept.
+func mergeSources(srcs map[string]*TopologySource) (map[string]SentinelPodConfig, []PodConflict) {
+	byPod := make(map[string][]sourcePod)
+	for _, src := range srcs {
+		for podname, pod := range src.Pods {
+			byPod[podname] = append(byPod[podname], sourcePod{source: src, pod: pod})
+		}
+	}
+	merged := make(map[string]SentinelPodConfig)
+	var conflicts []PodConflict
+	for podname, views := range byPod {
+		sort.Slice(views, func(i, j int) bool { return views[i].preferredOver(views[j]) })
+		current := copyPod(views[0].pod)
+		var conflict *PodConflict
+		for _, view := range views[1:] {
+			pod := view.pod
+			if current.Address() != pod.Address() {
+				if conflict == nil {
+					conflict = &PodConflict{Pod: podname, Source: views[0].source.Name, Masters: map[string]string{views[0].source.Name: current.Address()}}
+				}
+				conflict.Masters[view.source.Name] = pod.Address()
+				continue
+			}
+			for _, replica := range pod.KnownReplicas {
+				if !containsString(current.KnownReplicas, replica) {
+					current.KnownReplicas = append(current.KnownReplicas, replica)
+				}
+			}
+			for addr, runid := range pod.Sentinels {
+				if current.Sentinels[addr] == "" {
+					current.Sentinels[addr] = runid
+				}
+			}
+			if current.AuthToken == "" {
+				current.AuthToken = pod.AuthToken
+			}
+		}
+		merged[podname] = current
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Pod < conflicts[j].Pod })
+	return merged, conflicts
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSources loads every configured source. prev holds the sources as last
+// loaded; live sentinels are only queried again if refreshLive is set or
+// they are not in prev.
+func loadSources(prev map[string]*TopologySource, refreshLive bool) map[string]*TopologySource {
+	current := make(map[string]*TopologySource)
+	for _, path := range expandConfigPaths(fileSourcePatterns()) {
+		name := "file:" + path
+		current[name] = loadFileSource(path, prev[name])
+	}
+	for _, addr := range config.SentinelAddresses {
+		name := "sentinel:" + addr
+		if refreshLive || prev[name] == nil {
+			current[name] = loadLiveSource(addr, prev[name])
+		} else {
+			current[name] = prev[name]
+		}
+	}
+	return current
+}
+
+// loadTopology reloads every source, merges them and applies the resulting
+// topology to the node set. Live sentinels are only queried again if
+// refreshLive is set, otherwise their last results are reused.
+func loadTopology(refreshLive bool) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	current := loadSources(sources, refreshLive)
+	for _, src := range current {
+		if src.Error != "" {
+			logger.Warning("Unable to load " + src.Name + ": " + src.Error)
+		}
+	}
+	merged, conflicts := mergeSources(current)
+	logger.Info(fmt.Sprintf("Loaded %d pods from %d sources", len(merged), len(current)))
+	if conflictsString(conflicts) != conflictsString(podConflicts) {
+		for _, conflict := range conflicts {
+			logger.Warning(conflict.String())
+		}
+	}
+	diff := diffPods(sourcePods, merged)
+	diff.merge(applyTopology(buildTopology(merged, sourceSentinels(current))))
+	if !diff.Empty() {
+		logger.Warning("Topology changed: " + diff.String())
+	}
+	sources = current
+	sourcePods = merged
+	podConflicts = conflicts
+}
+
+func conflictsString(conflicts []PodConflict) string {
+	parts := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		parts = append(parts, conflict.String())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// sourceSentinels returns the addresses of the sentinels the sources belong to
+func sourceSentinels(srcs map[string]*TopologySource) []string {
+	var addrs []string
+	for _, src := range srcs {
+		if src.Sentinel != "" && !containsString(addrs, src.Sentinel) {
+			addrs = append(addrs, src.Sentinel)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// SourceStatus is the API view of a topology source
+type SourceStatus struct {
+	Name     string
+	Sentinel string
+	Pods     []string
+	Error    string
+	Loaded   time.Time
+}
+
+func handleTopology(w http.ResponseWriter, r *http.Request) {
+	sourcesLock.Lock()
+	status := []SourceStatus{}
+	for _, src := range sources {
+		s := SourceStatus{Name: src.Name, Sentinel: src.Sentinel, Error: src.Error, Loaded: src.Loaded, Pods: []string{}}
+		for name := range src.Pods {
+			s.Pods = append(s.Pods, name)
+		}
+		sort.Strings(s.Pods)
+		status = append(status, s)
+	}
+	conflicts := append([]PodConflict{}, podConflicts...)
+	sourcesLock.Unlock()
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Sources": status, "Conflicts": conflicts})
+}
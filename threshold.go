@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/therealbill/libredis/client"
+)
+
+// thresholdFor returns the latency-monitor-threshold configured for the node,
+// preferring a per-node override, then a per-pod one, then the global value.
+// Node overrides are keyed host/port as envconfig maps can't hold a ':'.
+func thresholdFor(nodename, podname string) int {
+	threshold, exists := config.NodeThresholds[strings.Replace(nodename, ":", "/", 1)]
+	if exists {
+		return threshold
+	}
+	threshold, exists = config.PodThresholds[podname]
+	if exists {
+		return threshold
+	}
+	return config.LatencyThreshold
+}
+
+// getThreshold reads the node's current latency-monitor-threshold
+func getThreshold(conn *client.Redis) (int, error) {
+	res, err := conn.ConfigGet("latency-monitor-threshold")
+	if err != nil {
+		return 0, err
+	}
+	value, exists := res["latency-monitor-threshold"]
+	if !exists {
+		return 0, fmt.Errorf("latency-monitor-threshold missing from CONFIG GET")
+	}
+	return strconv.Atoi(value)
+}
+
+// checkThreshold compares the node's latency-monitor-threshold with the one
+// configured for it and sets it if they differ, unless
+// config.ThresholdReportOnly is set. A change to a threshold already seen is
+// reported as drift once, not on every poll it persists; in report-only
+// mode a mismatch on the node's first check is reported too, as it won't be
+// fixed. In observe-only mode the threshold is only read.
+func (n *Node) checkThreshold(conn *client.Redis) error {
+	nodesLock.RLock()
+	desired := thresholdFor(n.Name, n.Pod.Name)
+	checked := n.thresholdChecked
+	previous := n.Threshold
+	nodesLock.RUnlock()
+	actual, err := getThreshold(conn)
+	if err != nil {
+		return err
+	}
+	nodesLock.Lock()
+	n.Threshold = actual
+	n.thresholdChecked = true
+	nodesLock.Unlock()
+	if actual == desired || config.ObserveOnly {
+		return nil
+	}
+	if (checked && actual != previous) || (!checked && config.ThresholdReportOnly) {
+		countThresholdDrift(n.Name)
+		annotate(n.Name, "threshold-drift", fmt.Sprintf("latency-monitor-threshold is %d, configured %d", actual, desired))
+	}
+	if config.ThresholdReportOnly {
+		return nil
+	}
+	err = conn.ConfigSetInt("latency-monitor-threshold", desired)
+	if err != nil {
+		return err
+	}
+	nodesLock.Lock()
+	n.Threshold = desired
+	nodesLock.Unlock()
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Node roles
+const (
+	RoleMaster   = "master"
+	RoleReplica  = "replica"
+	RoleSentinel = "sentinel"
+)
+
+// NodeSpec describes a node that should be monitored
+type NodeSpec struct {
+	Name string
+	Pod  SentinelPodConfig
+	Role string
+}
+
+// podNodeSpecs returns the master and every known replica of the pod, and
+// the pod's known sentinels if sentinel monitoring is enabled.
+func podNodeSpecs(pod SentinelPodConfig) []NodeSpec {
+	specs := []NodeSpec{{Name: pod.Address(), Pod: pod, Role: RoleMaster}}
+	for _, addr := range pod.KnownReplicas {
+		specs = append(specs, NodeSpec{Name: addr, Pod: pod, Role: RoleReplica})
+	}
+	if config.MonitorSentinels {
+		addrs := make([]string, 0, len(pod.Sentinels))
+		for addr := range pod.Sentinels {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			specs = append(specs, NodeSpec{Name: addr, Pod: pod, Role: RoleSentinel})
+		}
+	}
+	return specs
+}
+
+// buildTopology returns the nodes for every pod, plus the given sentinels if
+// sentinel monitoring is enabled. A node is only listed once; sentinels
+// watching several pods are attributed to the first pod by name.
+func buildTopology(pods map[string]SentinelPodConfig, sentinels []string) map[string]NodeSpec {
+	names := make([]string, 0, len(pods))
+	for name := range pods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	specs := make(map[string]NodeSpec)
+	for _, name := range names {
+		for _, spec := range podNodeSpecs(pods[name]) {
+			if _, exists := specs[spec.Name]; !exists {
+				specs[spec.Name] = spec
+			}
+		}
+	}
+	if config.MonitorSentinels {
+		for _, addr := range sentinels {
+			if _, exists := specs[addr]; !exists {
+				specs[addr] = NodeSpec{Name: addr, Role: RoleSentinel}
+			}
+		}
+	}
+	return specs
+}
+
+// TopologyDiff describes how a topology changed
+type TopologyDiff struct {
+	AddedPods   []string
+	RemovedPods []string
+	// ChangedPods had their master, quorum, replicas or sentinels change
+	ChangedPods []string
+	// AuthChangedPods had their auth-pass change
+	AuthChangedPods []string
+	AddedNodes      []string
+	RemovedNodes    []string
+	// ChangedNodes had their role or pod change
+	ChangedNodes []string
+}
+
+// diffPods compares two sets of pod configs
+func diffPods(old, cur map[string]SentinelPodConfig) (diff TopologyDiff) {
+	for name, pod := range cur {
+		prev, exists := old[name]
+		if !exists {
+			diff.AddedPods = append(diff.AddedPods, name)
+			continue
+		}
+		if prev.AuthToken != pod.AuthToken {
+			diff.AuthChangedPods = append(diff.AuthChangedPods, name)
+		}
+		if prev.Address() != pod.Address() || prev.Quorum != pod.Quorum ||
+			!reflect.DeepEqual(prev.KnownReplicas, pod.KnownReplicas) || !reflect.DeepEqual(prev.Sentinels, pod.Sentinels) {
+			diff.ChangedPods = append(diff.ChangedPods, name)
+		}
+	}
+	for name := range old {
+		if _, exists := cur[name]; !exists {
+			diff.RemovedPods = append(diff.RemovedPods, name)
+		}
+	}
+	diff.sort()
+	return diff
+}
+
+// merge adds the entries of other to the diff
+func (d *TopologyDiff) merge(other TopologyDiff) {
+	d.AddedPods = append(d.AddedPods, other.AddedPods...)
+	d.RemovedPods = append(d.RemovedPods, other.RemovedPods...)
+	d.ChangedPods = append(d.ChangedPods, other.ChangedPods...)
+	d.AuthChangedPods = append(d.AuthChangedPods, other.AuthChangedPods...)
+	d.AddedNodes = append(d.AddedNodes, other.AddedNodes...)
+	d.RemovedNodes = append(d.RemovedNodes, other.RemovedNodes...)
+	d.ChangedNodes = append(d.ChangedNodes, other.ChangedNodes...)
+	d.sort()
+}
+
+func (d *TopologyDiff) sort() {
+	for _, list := range [][]string{d.AddedPods, d.RemovedPods, d.ChangedPods, d.AuthChangedPods, d.AddedNodes, d.RemovedNodes, d.ChangedNodes} {
+		sort.Strings(list)
+	}
+}
+
+// Empty reports whether nothing changed
+func (d TopologyDiff) Empty() bool {
+	return len(d.AddedPods)+len(d.RemovedPods)+len(d.ChangedPods)+len(d.AuthChangedPods)+
+		len(d.AddedNodes)+len(d.RemovedNodes)+len(d.ChangedNodes) == 0
+}
+
+func (d TopologyDiff) String() string {
+	var parts []string
+	add := func(label string, list []string) {
+		if len(list) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", label, strings.Join(list, ",")))
+		}
+	}
+	add("pods added", d.AddedPods)
+	add("pods removed", d.RemovedPods)
+	add("pods changed", d.ChangedPods)
+	add("auth changed", d.AuthChangedPods)
+	add("nodes added", d.AddedNodes)
+	add("nodes removed", d.RemovedNodes)
+	add("nodes changed", d.ChangedNodes)
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
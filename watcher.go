@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDelay is how long the sentinel config must be quiet after a
+// change before it is reloaded, as sentinel rewrites it in several steps
+const configReloadDelay = 500 * time.Millisecond
+
+// watchingSentinelConfig is set once the sentinel config files are watched,
+// stopping the poll cycle from re-reading them
+var watchingSentinelConfig bool
+
+// reloadOnHangup reloads the topology, querying the live sentinels again,
+// whenever candui receives SIGHUP. It is installed whatever the sources are
+// so SIGHUP never falls back to its default of killing the daemon.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("Received SIGHUP, reloading topology")
+			loadTopology(true)
+		}
+	}()
+}
+
+// watchSentinelConfig reloads the topology whenever a sentinel config source
+// changes. The directories holding the sources are watched rather than the
+// files themselves since CONFIG REWRITE may replace a file, and new files
+// may match a directory or glob source. A directory which can't be watched
+// is skipped with a warning, and the sources are then also reloaded every
+// poll interval; it is only an error if nothing can be watched.
+func watchSentinelConfig() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	var watched []string
+	var failed error
+	for _, dir := range watchDirs() {
+		err = watcher.Add(dir)
+		if err != nil {
+			logger.Warning("Unable to watch " + dir + " for sentinel config changes: " + err.Error())
+			failed = err
+			continue
+		}
+		watched = append(watched, dir)
+	}
+	if len(watched) == 0 {
+		watcher.Close()
+		return failed
+	}
+	watchingSentinelConfig = failed == nil
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create != 0 && isSourceDir(event.Name) {
+					// a new directory matching a glob source
+					err := watcher.Add(event.Name)
+					if err != nil {
+						logger.Warning("Unable to watch " + event.Name + " for sentinel config changes: " + err.Error())
+					}
+					reload = time.After(configReloadDelay)
+					continue
+				}
+				if !isConfigSourceFile(event.Name) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					reload = time.After(configReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warning("Error watching sentinel config: " + err.Error())
+			case <-reload:
+				reload = nil
+				logger.Info("Sentinel config changed, reloading")
+				loadTopology(false)
+			}
+		}
+	}()
+	logger.Info("Watching " + strings.Join(watched, ", ") + " for sentinel config changes")
+	return nil
+}
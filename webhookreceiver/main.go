@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+var listen = flag.String("listen", ":9099", "address to listen on")
+
+// handleAlert prints every alert POSTed to it
+func handleAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST alerts here", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, body, "", "  ")
+	if err != nil {
+		log.Printf("Received invalid JSON from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("==== %s alert from %s ====\n%s\n", time.Now().Format(time.RFC3339), r.RemoteAddr, out.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func main() {
+	flag.Parse()
+	http.HandleFunc("/", handleAlert)
+	log.Printf("Listening for alerts on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}